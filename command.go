@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jinzhu/gorm"
+
+	"gitee.com/generals-space/site-mirror-go.git/crawler"
+	"gitee.com/generals-space/site-mirror-go.git/model"
+	"gitee.com/generals-space/site-mirror-go.git/util"
+)
+
+// stringsFlag 可重复指定的字符串选项, 如 -url a -url b
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var urlTypeNames = map[int]string{
+	model.URLTypePage:  "page",
+	model.URLTypeAsset: "asset",
+}
+
+var urlTaskStatusNames = map[int]string{
+	model.URLTaskStatusInit:    "init",
+	model.URLTaskStatusPending: "pending",
+	model.URLTaskStatusSuccess: "success",
+	model.URLTaskStatusFailed:  "failed",
+	model.URLTaskStatusSkipped: "skipped",
+}
+
+// runMirror mirror, resume与update子命令.
+// resume子命令不再将起始页面入队列, 只继续数据库中未完成的任务;
+// update子命令使用已有的数据库, 从起始页面开始以条件请求重新遍历整个站点, 并报告相对上一次抓取的变化.
+// resume与update如果未指定起始页面, 则从数据库中读取上一次的起始页面.
+func runMirror(args []string, name string) (err error) {
+	resume := name == "resume"
+	update := name == "update"
+	flagSet := flag.NewFlagSet(name, flag.ExitOnError)
+	config := crawler.NewConfig()
+
+	var startPages, blackList, headers, lazyLoadAttrs stringsFlag
+	var profilePath, logLevel string
+	flagSet.StringVar(&profilePath, "profile", "", "配置文件路径(.json, .yaml, .toml), 命令行选项优先于环境变量, 环境变量优先于配置文件")
+	flagSet.Var(&startPages, "url", "起始页面地址, 可多次指定, 第一个地址的域名作为主站点")
+	flagSet.IntVar(&config.MaxDepth, "depth", config.MaxDepth, "抓取深度, 0为不限深度, 1为只抓取单页面")
+	flagSet.IntVar(&config.PageWorkerCount, "page-workers", config.PageWorkerCount, "页面工作协程数量")
+	flagSet.IntVar(&config.AssetWorkerCount, "asset-workers", config.AssetWorkerCount, "静态资源工作协程数量")
+	flagSet.StringVar(&config.SiteDBPath, "db", config.SiteDBPath, "任务数据库路径")
+	flagSet.StringVar(&config.SitePath, "site", config.SitePath, "站点文件存储目录")
+	flagSet.StringVar(&config.Storage, "storage", config.Storage, "存储类型: local, memory, zip, tar, s3, s3的连接信息需要通过配置文件或环境变量指定")
+	flagSet.StringVar(&config.ArchivePath, "archive", config.ArchivePath, "zip与tar存储时的归档文件路径")
+	flagSet.StringVar(&config.WARCPath, "warc", config.WARCPath, "额外将原始请求与响应记录到此WARC文件中, 以.gz结尾时进行压缩")
+	flagSet.StringVar(&config.UserAgent, "ua", config.UserAgent, "请求使用的User-Agent")
+	flagSet.IntVar(&config.MaxRetryTimes, "retry", config.MaxRetryTimes, "请求出错(网络错误, 5xx, 429)最大重试次数")
+	flagSet.IntVar(&config.RetryBaseDelay, "retry-base-delay", config.RetryBaseDelay, "第一次重试前等待的时间(秒), 之后每次翻倍")
+	flagSet.IntVar(&config.RetryMaxDelay, "retry-max-delay", config.RetryMaxDelay, "重试前最多等待的时间(秒), 服务端返回的Retry-After更长时以其为准")
+	flagSet.StringVar(&config.CookiesFile, "cookies", config.CookiesFile, "导入Netscape格式的cookies.txt")
+	flagSet.StringVar(&config.LoginURL, "login-url", config.LoginURL, "表单登录地址, 登录字段需要通过配置文件或环境变量(login_fields)指定")
+	flagSet.StringVar(&config.Proxy, "proxy", config.Proxy, "代理地址, 支持http://, https://与socks5://, 为空时使用HTTP_PROXY等环境变量")
+	flagSet.IntVar(&config.ConnectTimeout, "connect-timeout", config.ConnectTimeout, "连接超时(秒), 0为不限制")
+	flagSet.IntVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "读超时(秒), 连续这么长时间没有收到数据时请求失败, 0为不限制")
+	flagSet.IntVar(&config.RequestTimeout, "timeout", config.RequestTimeout, "单个请求的总超时(秒), 0为不限制")
+	flagSet.StringVar(&config.CAFile, "ca-file", config.CAFile, "额外信任的CA证书(PEM格式)文件")
+	flagSet.BoolVar(&config.InsecureSkipVerify, "insecure", config.InsecureSkipVerify, "不校验https证书")
+	flagSet.IntVar(&config.HostMaxConns, "host-max-conns", config.HostMaxConns, "每个主机同时进行的最大请求数, 0为不限制")
+	flagSet.Float64Var(&config.HostDelay, "host-delay", config.HostDelay, "同一主机两次请求之间的最小间隔(秒)")
+	flagSet.Float64Var(&config.HostRPS, "host-rps", config.HostRPS, "每个主机每秒的最大请求数, 0为不限制")
+	flagSet.IntVar(&config.HostBurst, "host-burst", config.HostBurst, "按-host-rps限速时允许的突发请求数")
+	flagSet.BoolVar(&config.IgnoreRobots, "ignore-robots", config.IgnoreRobots, "不遵守robots.txt的限制与Crawl-delay, 只应用于抓取自己的站点")
+	flagSet.BoolVar(&config.RelativeLinks, "relative-links", config.RelativeLinks, "将链接改写为相对路径, 镜像可以直接从磁盘打开或部署在子目录下")
+	flagSet.BoolVar(&config.OutsiteAsset, "outsite-asset", config.OutsiteAsset, "是否抓取站外静态资源")
+	flagSet.BoolVar(&config.NoJs, "no-js", config.NoJs, "不抓取js资源")
+	flagSet.BoolVar(&config.NoCSS, "no-css", config.NoCSS, "不抓取css资源")
+	flagSet.BoolVar(&config.NoImages, "no-images", config.NoImages, "不抓取图片资源")
+	flagSet.BoolVar(&config.NoFonts, "no-fonts", config.NoFonts, "不抓取字体资源")
+	flagSet.BoolVar(&config.NoIframes, "no-iframes", config.NoIframes, "不抓取iframe中嵌入的页面")
+	flagSet.BoolVar(&config.NoFrames, "no-frames", config.NoFrames, "不抓取frameset中frame的页面")
+	flagSet.BoolVar(&config.NoObjects, "no-objects", config.NoObjects, "不抓取object中嵌入的内容")
+	flagSet.BoolVar(&config.NoEmbeds, "no-embeds", config.NoEmbeds, "不抓取embed中嵌入的内容")
+	flagSet.BoolVar(&config.NoAreas, "no-areas", config.NoAreas, "不抓取图像映射area中的链接")
+	flagSet.BoolVar(&config.NoForms, "no-forms", config.NoForms, "不抓取GET表单的action页面")
+	flagSet.Var(&blackList, "blacklist", "url黑名单正则, 可多次指定")
+	flagSet.Var(&lazyLoadAttrs, "lazy-attr", "额外的懒加载图片属性, 如data-lazy, 可多次指定")
+	flagSet.Var(&headers, "header", "额外的请求头, 格式为`Name: Value`, 可多次指定")
+	flagSet.StringVar(&logLevel, "log-level", "info", "日志级别: trace, debug, info, warn, error, fatal, off")
+	flagSet.Parse(args)
+
+	err = loadProfile(flagSet, config, profilePath)
+	if err != nil {
+		return
+	}
+
+	// 也可以直接将起始页面作为位置参数传入
+	startPages = append(startPages, flagSet.Args()...)
+	if len(startPages) == 0 && config.StartPage != "" {
+		startPages = append([]string{config.StartPage}, config.StartPages...)
+	}
+	config.BlackList = append(config.BlackList, blackList...)
+	config.LazyLoadAttrs = append(config.LazyLoadAttrs, lazyLoadAttrs...)
+	for _, header := range headers {
+		i := strings.Index(header, ":")
+		if i <= 0 {
+			err = fmt.Errorf("请求头格式不正确, 应为`Name: Value`: %s", header)
+			return
+		}
+		if config.Headers == nil {
+			config.Headers = map[string]string{}
+		}
+		config.Headers[strings.TrimSpace(header[:i])] = strings.TrimSpace(header[i+1:])
+	}
+
+	logger := util.NewLogger(os.Stdout)
+	util.SetLevel(logLevel)
+
+	if len(startPages) == 0 && (resume || update) {
+		var startPage string
+		startPage, err = queryStartPage(config.SiteDBPath)
+		if err != nil {
+			return
+		}
+		startPages = append(startPages, startPage)
+	}
+	if len(startPages) == 0 {
+		err = fmt.Errorf("未指定起始页面, 请使用 -url 选项")
+		return
+	}
+	config.StartPage = startPages[0]
+	config.StartPages = startPages[1:]
+	config.Update = update
+
+	c, err := crawler.NewCrawler(config, logger)
+	if err != nil {
+		return
+	}
+
+	// 收到中断信号时取消抓取, 否则等待抓取自动结束.
+	// 只处理第一个信号, 之后恢复默认行为, 取消过程卡住时再次Ctrl-C可以直接退出.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(channel)
+	go func() {
+		sig := <-channel
+		signal.Stop(channel)
+		logger.Infof("收到信号: %s, 用户取消, 再次发送信号将直接退出", sig)
+		cancel()
+	}()
+
+	if !resume {
+		c.EnqueueStartPages()
+	}
+	err = c.Run(ctx)
+	if err == context.Canceled {
+		// 用户主动取消不算出错, 之后可以通过resume子命令继续.
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	logger.Info("抓取完成")
+	if c.UpdateReport != nil {
+		printUpdateReport(c.UpdateReport)
+	}
+	return
+}
+
+// printUpdateReport 输出update子命令的变化统计, 以及新增, 修改与删除的页面列表.
+func printUpdateReport(report *crawler.UpdateReport) {
+	fmt.Printf("页面: 新增 %d, 修改 %d, 删除 %d\n", len(report.AddedPages), len(report.ChangedPages), len(report.RemovedPages))
+	fmt.Printf("静态资源: 新增 %d, 修改 %d, 删除 %d\n", report.AddedAssets, report.ChangedAssets, report.RemovedAssets)
+	for _, item := range []struct {
+		mark string
+		urls []string
+	}{
+		{"+", report.AddedPages},
+		{"~", report.ChangedPages},
+		{"-", report.RemovedPages},
+	} {
+		for _, url := range item.urls {
+			fmt.Printf("%s %s\n", item.mark, url)
+		}
+	}
+}
+
+// loadProfile 依次用配置文件与环境变量覆盖config, 最后重新应用命令行中显式指定的选项,
+// 保证优先级为: 命令行选项 > 环境变量 > 配置文件 > 默认值.
+func loadProfile(flagSet *flag.FlagSet, config *crawler.Config, profilePath string) (err error) {
+	setFlags := map[string]string{}
+	flagSet.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	*config = *crawler.NewConfig()
+	if profilePath != "" {
+		err = crawler.LoadProfile(profilePath, config)
+		if err != nil {
+			return
+		}
+	}
+	err = crawler.LoadProfileEnv(config)
+	if err != nil {
+		return
+	}
+
+	flagSet.Visit(func(f *flag.Flag) {
+		// 可重复的选项不绑定在config上, 无需重新应用
+		if _, ok := f.Value.(*stringsFlag); ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(setFlags[f.Name]); setErr != nil {
+			err = fmt.Errorf("选项-%s的值不正确: %s, %s", f.Name, setFlags[f.Name], setErr.Error())
+		}
+	})
+	return
+}
+
+// queryStartPage 从数据库中读取上一次抓取的起始页面
+func queryStartPage(dbPath string) (startPage string, err error) {
+	dbClient, err := model.GetDB(dbPath)
+	if err != nil {
+		err = fmt.Errorf("打开数据库失败: site db: %s, %s", dbPath, err.Error())
+		return
+	}
+	defer dbClient.Close()
+
+	task, err := model.QueryStartPage(dbClient)
+	if err != nil {
+		err = fmt.Errorf("数据库中没有起始页面记录, 请使用 -url 选项指定: %s", err.Error())
+		return
+	}
+	startPage = task.URL
+	return
+}
+
+// runStatus status子命令, 输出数据库中各类型各状态的任务数量
+func runStatus(args []string) (err error) {
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	config := crawler.NewConfig()
+	flagSet.StringVar(&config.SiteDBPath, "db", config.SiteDBPath, "任务数据库路径")
+	flagSet.Parse(args)
+
+	if _, err = os.Stat(config.SiteDBPath); err != nil {
+		err = fmt.Errorf("数据库不存在: site db: %s, %s", config.SiteDBPath, err.Error())
+		return
+	}
+	dbClient, err := model.OpenDB(config.SiteDBPath)
+	if err != nil {
+		err = fmt.Errorf("打开数据库失败: site db: %s, %s", config.SiteDBPath, err.Error())
+		return
+	}
+	defer dbClient.Close()
+
+	counts, err := model.CountURLRecords(dbClient)
+	if err != nil {
+		err = fmt.Errorf("统计任务数量失败: %s", err.Error())
+		return
+	}
+	total := 0
+	fmt.Printf("%-8s%-10s%s\n", "type", "status", "count")
+	for _, count := range counts {
+		fmt.Printf("%-8s%-10s%d\n", urlTypeNames[count.URLType], urlTaskStatusNames[count.Status], count.Count)
+		total += count.Count
+	}
+	fmt.Printf("%-18s%d\n", "total", total)
+	return
+}
+
+// runServe serve子命令, 启动静态服务器浏览已下载的站点.
+// 数据库存在时, 从中读取起始页面与各链接的原始url, 用于在"未镜像"页面中给出原始链接.
+// s3的连接信息与mirror子命令一样通过环境变量指定.
+func runServe(args []string) (err error) {
+	flagSet := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := crawler.NewConfig()
+	err = crawler.LoadProfileEnv(config)
+	if err != nil {
+		return
+	}
+	var addr, logLevel string
+	flagSet.StringVar(&config.Storage, "storage", config.Storage, "存储类型: local, s3, zip与tar归档需要先解压")
+	flagSet.StringVar(&config.SitePath, "site", config.SitePath, "站点文件存储目录")
+	flagSet.StringVar(&config.SiteDBPath, "db", config.SiteDBPath, "任务数据库路径, 不存在时忽略")
+	flagSet.StringVar(&config.StartPage, "url", "", "原站点的起始页面, 默认从数据库中读取")
+	flagSet.StringVar(&addr, "addr", ":8080", "监听地址")
+	flagSet.StringVar(&logLevel, "log-level", "info", "日志级别: trace, debug, info, warn, error, fatal, off")
+	flagSet.Parse(args)
+
+	logger := util.NewLogger(os.Stdout)
+	util.SetLevel(logLevel)
+
+	var dbClient *gorm.DB
+	if _, statErr := os.Stat(config.SiteDBPath); statErr == nil {
+		dbClient, err = model.GetDB(config.SiteDBPath)
+		if err != nil {
+			err = fmt.Errorf("打开数据库失败: site db: %s, %s", config.SiteDBPath, err.Error())
+			return
+		}
+		defer dbClient.Close()
+		if config.StartPage == "" {
+			task, queryErr := model.QueryStartPage(dbClient)
+			if queryErr == nil {
+				config.StartPage = task.URL
+			}
+		}
+	}
+
+	if config.Storage != crawler.StorageLocal && config.Storage != crawler.StorageS3 {
+		err = fmt.Errorf("serve不支持的存储类型: %s, 可选值为local, s3", config.Storage)
+		return
+	}
+	store, err := crawler.NewStorage(config)
+	if err != nil {
+		err = fmt.Errorf("初始化存储失败: storage: %s, %s", config.Storage, err.Error())
+		return
+	}
+	server, err := crawler.NewServer(store, config.StartPage, dbClient, logger)
+	if err != nil {
+		err = fmt.Errorf("创建静态服务器失败: %s", err.Error())
+		return
+	}
+	logger.Infof("启动静态服务器: addr: %s, storage: %s, site: %s, origin: %s", addr, config.Storage, config.SitePath, config.StartPage)
+	err = http.ListenAndServe(addr, server)
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitee.com/generals-space/site-mirror-go.git/crawler"
+)
+
+// 优先级为: 命令行选项 > 环境变量 > 配置文件 > 默认值
+func TestLoadProfilePrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profilePath := filepath.Join(dir, "site.json")
+	err = ioutil.WriteFile(profilePath, []byte(`{"max_depth": 3, "page_worker_count": 7, "asset_worker_count": 8, "no_js": false}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SITE_MIRROR_PAGE_WORKER_COUNT", "9")
+	os.Setenv("SITE_MIRROR_MAX_DEPTH", "4")
+	defer os.Unsetenv("SITE_MIRROR_PAGE_WORKER_COUNT")
+	defer os.Unsetenv("SITE_MIRROR_MAX_DEPTH")
+
+	tests := []struct {
+		name   string
+		args   []string
+		want   crawler.Config
+		noFile bool
+	}{
+		{
+			name: "命令行选项优先",
+			args: []string{"-depth", "5", "-no-js"},
+			want: crawler.Config{MaxDepth: 5, PageWorkerCount: 9, AssetWorkerCount: 8, NoJs: true},
+		},
+		{
+			name: "没有命令行选项时环境变量优先于配置文件",
+			args: []string{},
+			want: crawler.Config{MaxDepth: 4, PageWorkerCount: 9, AssetWorkerCount: 8, NoJs: false},
+		},
+		{
+			name: "与默认值相同的命令行选项同样优先",
+			args: []string{"-depth", "0", "-asset-workers", "5"},
+			want: crawler.Config{MaxDepth: 0, PageWorkerCount: 9, AssetWorkerCount: 5, NoJs: false},
+		},
+		{
+			name:   "没有配置文件",
+			args:   []string{"-asset-workers", "6"},
+			want:   crawler.Config{MaxDepth: 4, PageWorkerCount: 9, AssetWorkerCount: 6, NoJs: true},
+			noFile: true,
+		},
+	}
+	for _, test := range tests {
+		config := crawler.NewConfig()
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		var blackList stringsFlag
+		flagSet.IntVar(&config.MaxDepth, "depth", config.MaxDepth, "")
+		flagSet.IntVar(&config.PageWorkerCount, "page-workers", config.PageWorkerCount, "")
+		flagSet.IntVar(&config.AssetWorkerCount, "asset-workers", config.AssetWorkerCount, "")
+		flagSet.BoolVar(&config.NoJs, "no-js", config.NoJs, "")
+		flagSet.Var(&blackList, "blacklist", "")
+		err = flagSet.Parse(append(test.args, "-blacklist", "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := profilePath
+		if test.noFile {
+			path = ""
+		}
+		err = loadProfile(flagSet, config, path)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if config.MaxDepth != test.want.MaxDepth || config.PageWorkerCount != test.want.PageWorkerCount ||
+			config.AssetWorkerCount != test.want.AssetWorkerCount || config.NoJs != test.want.NoJs {
+			t.Errorf("%s: depth=%d, page-workers=%d, asset-workers=%d, no-js=%t, 应为%d, %d, %d, %t", test.name,
+				config.MaxDepth, config.PageWorkerCount, config.AssetWorkerCount, config.NoJs,
+				test.want.MaxDepth, test.want.PageWorkerCount, test.want.AssetWorkerCount, test.want.NoJs)
+		}
+		// 可重复的选项不会被重复添加
+		if len(blackList) != 1 {
+			t.Errorf("%s: blacklist = %v, 应为[a]", test.name, blackList)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// setAuthHeader 为主站点的请求设置Authorization请求头.
+// 凭证只发送给主站点, 不会泄露给站外资源所在的主机(如CDN).
+func (crawler *Crawler) setAuthHeader(req *http.Request) {
+	if req.URL.Host != crawler.Config.MainSite {
+		return
+	}
+	if crawler.Config.AuthBearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+crawler.Config.AuthBearerToken)
+	} else if crawler.Config.AuthBasicUser != "" {
+		req.SetBasicAuth(crawler.Config.AuthBasicUser, crawler.Config.AuthBasicPassword)
+	}
+}
+
+// Login 模拟表单登录, 以application/x-www-form-urlencoded格式向LoginURL提交LoginFields,
+// 响应(包括重定向过程中)设置的会话cookie由cookie jar保存, 之后的请求都会带上.
+// 最终响应不是2xx时认为登录失败.
+func (crawler *Crawler) Login(ctx context.Context) (err error) {
+	form := url.Values{}
+	for key, value := range crawler.Config.LoginFields {
+		form.Set(key, value)
+	}
+	req, err := http.NewRequest("POST", crawler.Config.LoginURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", crawler.Config.UserAgent)
+	crawler.setAuthHeader(req)
+	crawler.setHeaders(req)
+
+	resp, err := crawler.HTTPClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("登录请求失败: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("登录失败: url: %s, status: %s", resp.Request.URL.String(), resp.Status)
+		return
+	}
+	logger.Infof("登录完成: url: %s, 当前cookie数量: %d", crawler.Config.LoginURL, crawler.CookieJar.Count())
+	return
+}
@@ -1,44 +1,147 @@
 package crawler
 
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
 // Config ...
+// json标签同时作为配置文件(json/yaml/toml)中的键名, 环境变量名为其大写形式加SITE_MIRROR_前缀,
+// 详见profile.go
 type Config struct {
-	// 单个页面中可能包含链接的最大数量
-	// 用LinkRatioInSinglePage*PageWorkerCount得到PageQueueSize,
-	// 这是为了防止由于队列满而造成worker阻塞引起的列锁,
-	// 但仍然可能由于递归抓取而写满队列
-	LinkRatioInSinglePage int
-	PageWorkerCount       int
-	AssetWorkerCount      int
-
-	SiteDBPath string
-	SitePath   string
-
-	StartPage string
-	MainSite  string
-	UserAgent string
+	PageWorkerCount  int `json:"page_worker_count"`
+	AssetWorkerCount int `json:"asset_worker_count"`
+
+	SiteDBPath string `json:"site_db_path"`
+	SitePath   string `json:"site_path"`
+
+	// 存储后端: local(默认, 存储到SitePath目录), memory, zip, tar, s3
+	Storage string `json:"storage"`
+	// zip与tar存储时的归档文件路径, tar归档以.gz或.tgz结尾时会进行gzip压缩
+	ArchivePath string `json:"archive_path"`
+	// s3存储的配置, 兼容MinIO等S3协议的对象存储
+	S3Endpoint  string `json:"s3_endpoint"`
+	S3Region    string `json:"s3_region"`
+	S3Bucket    string `json:"s3_bucket"`
+	S3AccessKey string `json:"s3_access_key"`
+	S3SecretKey string `json:"s3_secret_key"`
+	S3Prefix    string `json:"s3_prefix"`
+	S3PathStyle bool   `json:"s3_path_style"`
+	// 不为空时, 额外将所有原始的请求与响应记录到此WARC文件中, 以.gz结尾时进行压缩
+	WARCPath string `json:"warc_path"`
+
+	StartPage string `json:"start_page"`
+	// 额外的起始页面, 与StartPage一同入队列, 需要与StartPage同站
+	StartPages []string `json:"start_pages"`
+	// 由StartPage解析得到, 不可配置
+	MainSite string `json:"-"`
+	// update模式, 由update子命令设置: 使用条件请求重新遍历整个站点, 只重写有变化的文件
+	Update    bool   `json:"-"`
+	UserAgent string `json:"user_agent"`
+	// User-Agent池, 不为空时每个url按其哈希值固定使用其中一个, 而不是UserAgent.
+	// robots.txt的规则仍然按照UserAgent匹配.
+	UserAgents []string `json:"user_agents"`
+	// 所有请求都会带上的额外请求头, 如Accept-Language
+	Headers map[string]string `json:"headers"`
+	// 只对url匹配正则的请求设置的请求头, 按顺序应用, 后面的规则覆盖前面的同名请求头
+	HeaderRules []*HeaderRule `json:"header_rules"`
 	// 爬取页面的深度, 从1开始计, 爬到第N层为止.
 	// 1表示只抓取单页, 0表示无限制
-	MaxDepth int
-	// 请求出错最大重试次数(超时也算出错)
-	MaxRetryTimes int
-
-	OutsiteAsset bool
-	NoJs         bool
-	NoCSS        bool
-	NoImages     bool
-	NoFonts      bool
-	BlackList    []string
+	MaxDepth int `json:"max_depth"`
+	// 请求出错最大重试次数(超时, 5xx, 429也算出错)
+	MaxRetryTimes int `json:"max_retry_times"`
+	// 重试的指数退避时间, 第n次失败后等待RetryBaseDelay * 2^(n-1)秒, 最多RetryMaxDelay秒
+	RetryBaseDelay int `json:"retry_base_delay"`
+	RetryMaxDelay  int `json:"retry_max_delay"`
+	// 每个主机的默认请求限制, 站外资源所在的主机各自独立计算, 为0时不限制.
+	// HostDelay为两次请求之间的最小间隔(秒), HostRPS与HostBurst为令牌桶限速.
+	HostMaxConns int     `json:"host_max_conns"`
+	HostDelay    float64 `json:"host_delay"`
+	HostRPS      float64 `json:"host_rps"`
+	HostBurst    int     `json:"host_burst"`
+	// 按主机名正则指定的请求限制, 使用第一条匹配的规则, 都不匹配时使用上面的默认限制
+	HostLimits []*HostLimit `json:"host_limits"`
+	// 连接超时, 读超时(连续多久没有收到数据), 整个请求的超时, 单位秒, 为0时不限制
+	ConnectTimeout int `json:"connect_timeout"`
+	ReadTimeout    int `json:"read_timeout"`
+	RequestTimeout int `json:"request_timeout"`
+	// 代理地址, 支持http://, https://与socks5://, 为空时使用HTTP_PROXY等环境变量
+	Proxy string `json:"proxy"`
+	// 额外信任的CA证书(PEM格式)文件, 在系统证书的基础上追加
+	CAFile             string `json:"ca_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// 连接池大小, 以及空闲连接保持的时间(秒)
+	MaxIdleConns        int `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host"`
+	IdleConnTimeout     int `json:"idle_conn_timeout"`
+	// 导入Netscape格式的cookies.txt(浏览器插件或curl导出), cookie jar本身保存在SiteDBPath旁的.cookies.json文件中
+	CookiesFile string `json:"cookies_file"`
+	// 发送给主站点的Authorization请求头, 同时指定时AuthBearerToken优先
+	AuthBearerToken   string `json:"auth_bearer_token"`
+	AuthBasicUser     string `json:"auth_basic_user"`
+	AuthBasicPassword string `json:"auth_basic_password"`
+	// 表单登录, 抓取开始前向LoginURL提交LoginFields, 之后的请求带上登录得到的cookie
+	LoginURL    string            `json:"login_url"`
+	LoginFields map[string]string `json:"login_fields"`
+	// 为true时不检查robots.txt, 也不遵守其中的Crawl-delay, 只应用于抓取自己的站点
+	IgnoreRobots bool `json:"ignore_robots"`
+	// 为true时页面与css中的链接改写为相对于所在文件的相对路径(而不是以/起始的根路径),
+	// 镜像可以直接从磁盘打开, 或是部署在子目录下
+	RelativeLinks bool `json:"relative_links"`
+
+	OutsiteAsset bool     `json:"outsite_asset"`
+	NoJs         bool     `json:"no_js"`
+	NoCSS        bool     `json:"no_css"`
+	NoImages     bool     `json:"no_images"`
+	NoFonts      bool     `json:"no_fonts"`
+	BlackList    []string `json:"black_list"`
+	// 分别不解析iframe, frame, object, embed, 图像映射area, 以及GET表单的action中的链接
+	NoIframes bool `json:"no_iframes"`
+	NoFrames  bool `json:"no_frames"`
+	NoObjects bool `json:"no_objects"`
+	NoEmbeds  bool `json:"no_embeds"`
+	NoAreas   bool `json:"no_areas"`
+	NoForms   bool `json:"no_forms"`
+	// 懒加载图片使用的属性, 与src一样解析并改写, 以srcset结尾的属性按srcset的格式解析
+	LazyLoadAttrs []string `json:"lazy_load_attrs"`
 }
 
+// DefaultUserAgent 默认的User-Agent, 不带User-Agent的请求会被很多站点拒绝或限速
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/73.0.3683.86 Safari/537.36"
+
 // NewConfig 获取默认配置
 func NewConfig() (config *Config) {
 	config = &Config{
-		LinkRatioInSinglePage: 5000,
-		PageWorkerCount:       10,
-		AssetWorkerCount:      10,
+		PageWorkerCount:  10,
+		AssetWorkerCount: 10,
 
 		SiteDBPath: "site.db",
 		SitePath:   "sites",
+		Storage:    StorageLocal,
+
+		StartPages: []string{},
+
+		UserAgent:   DefaultUserAgent,
+		UserAgents:  []string{},
+		Headers:     map[string]string{},
+		HeaderRules: []*HeaderRule{},
+
+		MaxRetryTimes:  3,
+		RetryBaseDelay: 2,
+		RetryMaxDelay:  300,
+
+		HostMaxConns: 4,
+		HostLimits:   []*HostLimit{},
+
+		LoginFields: map[string]string{},
+
+		ConnectTimeout:      10,
+		ReadTimeout:         30,
+		RequestTimeout:      300,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90,
 
 		OutsiteAsset: true,
 		NoJs:         true,
@@ -46,7 +149,144 @@ func NewConfig() (config *Config) {
 		NoImages:     false,
 		NoFonts:      false,
 		BlackList:    []string{},
+
+		LazyLoadAttrs: []string{"data-src", "data-original", "data-srcset", "data-lazy-src"},
 	}
 
 	return
 }
+
+// Validate 检查配置是否合法, 在创建Crawler前调用, 以免运行时才出错.
+func (config *Config) Validate() (err error) {
+	if config.StartPage == "" {
+		err = fmt.Errorf("start_page: 未指定起始页面")
+		return
+	}
+	startPages := append([]string{config.StartPage}, config.StartPages...)
+	for _, startPage := range startPages {
+		var urlObj *url.URL
+		urlObj, err = url.Parse(startPage)
+		if err != nil {
+			err = fmt.Errorf("start_page: 起始页面地址不合法: %s, %s", startPage, err.Error())
+			return
+		}
+		if urlObj.Scheme != "http" && urlObj.Scheme != "https" {
+			err = fmt.Errorf("start_page: 起始页面必须是http(s)地址: %s", startPage)
+			return
+		}
+	}
+	if config.PageWorkerCount <= 0 {
+		err = fmt.Errorf("page_worker_count: 页面工作协程数量必须大于0, 当前为%d", config.PageWorkerCount)
+		return
+	}
+	if config.AssetWorkerCount <= 0 {
+		err = fmt.Errorf("asset_worker_count: 静态资源工作协程数量必须大于0, 当前为%d", config.AssetWorkerCount)
+		return
+	}
+	if config.MaxDepth < 0 {
+		err = fmt.Errorf("max_depth: 抓取深度不能小于0, 当前为%d", config.MaxDepth)
+		return
+	}
+	if config.MaxRetryTimes < 0 {
+		err = fmt.Errorf("max_retry_times: 重试次数不能小于0, 当前为%d", config.MaxRetryTimes)
+		return
+	}
+	if config.RetryBaseDelay < 0 || config.RetryMaxDelay < 0 {
+		err = fmt.Errorf("retry_base_delay, retry_max_delay: 重试等待时间不能小于0")
+		return
+	}
+	switch config.Storage {
+	case StorageLocal, StorageMemory:
+	case StorageZip, StorageTar:
+		if config.ArchivePath == "" {
+			err = fmt.Errorf("archive_path: %s存储需要指定归档文件路径", config.Storage)
+			return
+		}
+	case StorageS3:
+		if config.S3Endpoint == "" || config.S3Bucket == "" {
+			err = fmt.Errorf("s3_endpoint, s3_bucket: s3存储需要指定服务地址与bucket")
+			return
+		}
+	default:
+		err = fmt.Errorf("storage: 不支持的存储类型: %s, 可选值为local, memory, zip, tar, s3", config.Storage)
+		return
+	}
+	if config.HostMaxConns < 0 || config.HostDelay < 0 || config.HostRPS < 0 || config.HostBurst < 0 {
+		err = fmt.Errorf("host_max_conns, host_delay, host_rps, host_burst: 主机请求限制不能小于0")
+		return
+	}
+	for i, limit := range config.HostLimits {
+		if _, err = regexp.Compile(limit.Pattern); err != nil {
+			err = fmt.Errorf("host_limits[%d]: 主机名正则不合法: %s, %s", i, limit.Pattern, err.Error())
+			return
+		}
+		if limit.MaxConns < 0 || limit.Delay < 0 || limit.RPS < 0 || limit.Burst < 0 {
+			err = fmt.Errorf("host_limits[%d]: 主机请求限制不能小于0", i)
+			return
+		}
+	}
+	if config.ConnectTimeout < 0 || config.ReadTimeout < 0 || config.RequestTimeout < 0 {
+		err = fmt.Errorf("connect_timeout, read_timeout, request_timeout: 超时时间不能小于0")
+		return
+	}
+	if config.MaxIdleConns < 0 || config.MaxIdleConnsPerHost < 0 || config.IdleConnTimeout < 0 {
+		err = fmt.Errorf("max_idle_conns, max_idle_conns_per_host, idle_conn_timeout: 连接池配置不能小于0")
+		return
+	}
+	if config.Proxy != "" {
+		var proxyURL *url.URL
+		proxyURL, err = url.Parse(config.Proxy)
+		if err != nil {
+			err = fmt.Errorf("proxy: 代理地址不合法: %s, %s", config.Proxy, err.Error())
+			return
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			err = fmt.Errorf("proxy: 不支持的代理协议: %s, 可选值为http, https, socks5", proxyURL.Scheme)
+			return
+		}
+	}
+	for i, rule := range config.HeaderRules {
+		if _, err = regexp.Compile(rule.Pattern); err != nil {
+			err = fmt.Errorf("header_rules[%d]: url正则不合法: %s, %s", i, rule.Pattern, err.Error())
+			return
+		}
+	}
+	if config.LoginURL != "" {
+		var urlObj *url.URL
+		urlObj, err = url.Parse(config.LoginURL)
+		if err != nil || (urlObj.Scheme != "http" && urlObj.Scheme != "https") {
+			err = fmt.Errorf("login_url: 登录地址必须是http(s)地址: %s", config.LoginURL)
+			return
+		}
+	}
+	for i, attr := range config.LazyLoadAttrs {
+		if !attrNamePattern.MatchString(attr) {
+			err = fmt.Errorf("lazy_load_attrs[%d]: 属性名不合法: %s", i, attr)
+			return
+		}
+	}
+	for i, rule := range config.BlackList {
+		if _, err = regexp.Compile(rule); err != nil {
+			err = fmt.Errorf("black_list[%d]: 黑名单正则不合法: %s, %s", i, rule, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// DefaultHostLimit 没有匹配的HostLimits规则时使用的主机请求限制
+func (config *Config) DefaultHostLimit() *HostLimit {
+	return &HostLimit{
+		MaxConns: config.HostMaxConns,
+		Delay:    config.HostDelay,
+		RPS:      config.HostRPS,
+		Burst:    config.HostBurst,
+	}
+}
+
+// CookieJarPath cookie jar的持久化文件路径, 与任务数据库放在一起, 继续抓取时可以保持登录状态.
+func (config *Config) CookieJarPath() string {
+	return config.SiteDBPath + ".cookies.json"
+}
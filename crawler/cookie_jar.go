@@ -0,0 +1,218 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// savedCookie 持久化的cookie, 保留设置时的url, 恢复时按原样重新设置到jar中,
+// 由标准库的cookiejar处理domain, path与secure的匹配规则.
+type savedCookie struct {
+	URL    string       `json:"url"`
+	Cookie *http.Cookie `json:"cookie"`
+}
+
+// CookieJar 可以持久化的cookie jar.
+// 标准库的cookiejar.Jar不能导出其中的cookie, 这里额外记录每次设置的cookie,
+// 在抓取结束(或中断)时保存到文件中, 继续抓取时重新加载, 以保持登录状态.
+type CookieJar struct {
+	FilePath string
+
+	jar     *cookiejar.Jar
+	mutex   *sync.Mutex
+	cookies map[string]*savedCookie
+}
+
+// NewCookieJar 创建cookie jar, 文件已存在时从中加载未过期的cookie.
+func NewCookieJar(filePath string) (cookieJar *CookieJar, err error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return
+	}
+	cookieJar = &CookieJar{
+		FilePath: filePath,
+
+		jar:     jar,
+		mutex:   &sync.Mutex{},
+		cookies: map[string]*savedCookie{},
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	saved := []*savedCookie{}
+	err = json.Unmarshal(content, &saved)
+	if err != nil {
+		err = fmt.Errorf("解析cookie文件失败: %s, %s", filePath, err.Error())
+		return
+	}
+	for _, item := range saved {
+		var urlObj *url.URL
+		urlObj, err = url.Parse(item.URL)
+		if err != nil {
+			err = fmt.Errorf("解析cookie文件失败: %s, %s", filePath, err.Error())
+			return
+		}
+		cookieJar.SetCookies(urlObj, []*http.Cookie{item.Cookie})
+	}
+	return
+}
+
+// cookieKey cookie的唯一标识, 与浏览器一致由domain, path与name确定
+func cookieKey(urlObj *url.URL, cookie *http.Cookie) string {
+	domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")
+	if domain == "" {
+		domain = urlObj.Hostname()
+	}
+	return domain + ";" + cookie.Path + ";" + cookie.Name
+}
+
+// SetCookies 实现http.CookieJar接口
+func (cookieJar *CookieJar) SetCookies(urlObj *url.URL, cookies []*http.Cookie) {
+	cookieJar.jar.SetCookies(urlObj, cookies)
+
+	cookieJar.mutex.Lock()
+	defer cookieJar.mutex.Unlock()
+	now := time.Now()
+	for _, cookie := range cookies {
+		key := cookieKey(urlObj, cookie)
+		// MaxAge小于0或过期时间已过, 表示删除cookie
+		if cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(now)) {
+			delete(cookieJar.cookies, key)
+			continue
+		}
+		saved := *cookie
+		// MaxAge是相对时间, 保存时转换为绝对的过期时间
+		if saved.MaxAge > 0 {
+			saved.Expires = now.Add(time.Duration(saved.MaxAge) * time.Second)
+			saved.MaxAge = 0
+		}
+		saved.Raw = ""
+		saved.RawExpires = ""
+		cookieJar.cookies[key] = &savedCookie{
+			URL:    urlObj.Scheme + "://" + urlObj.Host + urlObj.Path,
+			Cookie: &saved,
+		}
+	}
+}
+
+// Cookies 实现http.CookieJar接口
+func (cookieJar *CookieJar) Cookies(urlObj *url.URL) []*http.Cookie {
+	return cookieJar.jar.Cookies(urlObj)
+}
+
+// Count 当前保存的cookie数量
+func (cookieJar *CookieJar) Count() int {
+	cookieJar.mutex.Lock()
+	defer cookieJar.mutex.Unlock()
+	return len(cookieJar.cookies)
+}
+
+// Save 将未过期的cookie写入文件, 先写临时文件再重命名, 避免中途出错时破坏原文件.
+// 文件中包含登录凭证, 权限设置为只有当前用户可读写.
+func (cookieJar *CookieJar) Save() (err error) {
+	cookieJar.mutex.Lock()
+	now := time.Now()
+	saved := []*savedCookie{}
+	for _, item := range cookieJar.cookies {
+		if !item.Cookie.Expires.IsZero() && item.Cookie.Expires.Before(now) {
+			continue
+		}
+		saved = append(saved, item)
+	}
+	cookieJar.mutex.Unlock()
+
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return
+	}
+	tmpPath := cookieJar.FilePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmpPath, cookieJar.FilePath)
+	return
+}
+
+// ImportNetscapeCookies 导入浏览器插件或curl导出的Netscape格式cookies.txt.
+// 每行依次为domain, 是否包含子域名, path, 是否只用于https, 过期时间戳, name, value, 以tab分隔.
+// 以`#HttpOnly_`开头的行是HttpOnly的cookie, 其他以`#`开头的行为注释.
+func (cookieJar *CookieJar) ImportNetscapeCookies(filePath string) (count int, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, "#HttpOnly_") {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+			httpOnly = true
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			err = fmt.Errorf("cookies.txt第%d行格式不正确, 需要以tab分隔的7列", lineNum)
+			return
+		}
+		domain := fields[0]
+		includeSubdomains := strings.EqualFold(fields[1], "TRUE")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		var expires int64
+		expires, err = strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("cookies.txt第%d行过期时间不正确: %s", lineNum, fields[4])
+			return
+		}
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		// 包含子域名时设置Domain属性, 否则为只匹配该主机的cookie
+		if includeSubdomains {
+			cookie.Domain = domain
+		}
+		// 过期时间为0的是会话cookie
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		urlObj := &url.URL{
+			Scheme: scheme,
+			Host:   strings.TrimPrefix(domain, "."),
+			Path:   fields[2],
+		}
+		cookieJar.SetCookies(urlObj, []*http.Cookie{cookie})
+		count++
+	}
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,146 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cookieNamesFor 返回jar中发往rawURL的cookie名称(排序后以逗号连接)
+func cookieNamesFor(t *testing.T, cookieJar *CookieJar, rawURL string) string {
+	urlObj, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, cookie := range cookieJar.Cookies(urlObj) {
+		names = append(names, cookie.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestImportNetscapeCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	future := strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10)
+	lines := []string{
+		"# Netscape HTTP Cookie File",
+		"# https://curl.se/docs/http-cookies.html",
+		"",
+		// HttpOnly的会话cookie(过期时间为0), 包含子域名
+		"#HttpOnly_.example.com\tTRUE\t/\tFALSE\t0\tsession\tabc",
+		// 只用于https, 只匹配该主机与路径
+		"example.org\tFALSE\t/app\tTRUE\t" + future + "\ttoken\txyz",
+		// 已经过期
+		"example.com\tFALSE\t/\tFALSE\t1000\texpired\tv",
+		// windows换行
+		"example.com\tFALSE\t/\tFALSE\t" + future + "\tcrlf\tv\r",
+	}
+	filePath := filepath.Join(dir, "cookies.txt")
+	err = ioutil.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookieJar, err := NewCookieJar(filepath.Join(dir, "cookies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := cookieJar.ImportNetscapeCookies(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("导入了%d条cookie, 应为4条", count)
+	}
+
+	tests := []struct {
+		rawURL string
+		names  string
+	}{
+		{"http://example.com/", "crlf,session"},
+		{"http://www.example.com/a", "session"},
+		{"https://example.org/app/page", "token"},
+		{"https://example.org/app", "token"},
+		{"http://example.org/app/page", ""},
+		{"https://sub.example.org/app/page", ""},
+		{"https://example.org/other", ""},
+	}
+	for _, test := range tests {
+		if names := cookieNamesFor(t, cookieJar, test.rawURL); names != test.names {
+			t.Errorf("%s的cookie为[%s], 应为[%s]", test.rawURL, names, test.names)
+		}
+	}
+
+	// #HttpOnly_前缀不属于domain, 过期时间为0的是会话cookie
+	var session *savedCookie
+	for _, item := range cookieJar.cookies {
+		if item.Cookie.Name == "session" {
+			session = item
+		}
+	}
+	if session == nil {
+		t.Fatal("没有找到session cookie")
+	}
+	if !session.Cookie.HttpOnly || !session.Cookie.Expires.IsZero() || session.Cookie.Domain != ".example.com" {
+		t.Errorf("session cookie = %+v, 应为HttpOnly, 没有过期时间, domain为.example.com", session.Cookie)
+	}
+
+	// 保存后重新加载, 未过期的cookie仍然有效
+	err = cookieJar.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieJar, err = NewCookieJar(filepath.Join(dir, "cookies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		if names := cookieNamesFor(t, cookieJar, test.rawURL); names != test.names {
+			t.Errorf("重新加载后%s的cookie为[%s], 应为[%s]", test.rawURL, names, test.names)
+		}
+	}
+}
+
+func TestImportNetscapeCookiesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"# comment\nexample.com\tFALSE\t/\tFALSE\t0\tname\n", "第2行"},
+		{"example.com FALSE / FALSE 0 name value\n", "第1行"},
+		{"example.com\tFALSE\t/\tFALSE\tnever\tname\tvalue\n", "过期时间"},
+	}
+	for _, test := range tests {
+		filePath := filepath.Join(dir, "cookies.txt")
+		err = ioutil.WriteFile(filePath, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookieJar, err := NewCookieJar(filepath.Join(dir, "cookies.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cookieJar.ImportNetscapeCookies(filePath)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("导入%q应当报错(%s), 实际为%v", test.content, test.message, err)
+		}
+	}
+}
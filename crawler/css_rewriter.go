@@ -0,0 +1,338 @@
+package crawler
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// RewriteCSSURLs 按照css语法(CSS Syntax Level 3的分词规则)找出css内容中引用的url, 逐个交给rewrite处理,
+// rewrite返回的ok为true时将该url原地替换为newURL, 其余内容保持不变.
+// 处理以下几种引用:
+//
+// - url(a.png), url("a.png"), url('a.png'), 包括@font-face的src列表与@import url(...)
+// - @import "a.css"
+// - image-set("a.png" 1x, "b.png" 2x)与-webkit-image-set(...)中直接出现的字符串
+//
+// 注释中的内容会被忽略; url中的转义字符(如\28, \))会先解码再交给rewrite, 替换时按照所在位置重新转义.
+func RewriteCSSURLs(css string, rewrite func(rawURL string) (newURL string, ok bool)) string {
+	var output strings.Builder
+	last := 0
+	replace := func(start int, end int, value string, quote byte) {
+		newURL, ok := rewrite(unescapeCSS(value))
+		if !ok {
+			return
+		}
+		output.WriteString(css[last:start])
+		output.WriteString(escapeCSSURL(newURL, quote))
+		last = end
+	}
+
+	// 括号的嵌套深度, image-set()只处理其直接参数中的字符串, 不包括type("image/avif")这样嵌套的函数.
+	depth := 0
+	imageSetDepths := []int{}
+	// url("...")中的字符串所在的深度, 为0时表示不在url()中
+	urlStringDepth := 0
+	// 刚刚读取到@import, 之后的第一个字符串是要导入的文件
+	expectImport := false
+
+	i := 0
+	for i < len(css) {
+		char := css[i]
+		switch {
+		case char == '/' && i+1 < len(css) && css[i+1] == '*':
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				i = len(css)
+			} else {
+				i += 2 + end + 2
+			}
+		case char == '"' || char == '\'':
+			start, end, next, ok := scanCSSString(css, i)
+			inImageSet := len(imageSetDepths) > 0 && imageSetDepths[len(imageSetDepths)-1] == depth
+			if ok && (expectImport || (urlStringDepth > 0 && urlStringDepth == depth) || inImageSet) {
+				replace(start, end, css[start:end], char)
+			}
+			expectImport = false
+			urlStringDepth = 0
+			i = next
+		case char == '\\' || char == '-' || char == '_' || char == '@' || isCSSNameChar(char):
+			start := i
+			if char == '@' {
+				i++
+			}
+			i = scanCSSName(css, i)
+			if i == start {
+				// 不能作为转义的反斜线(之后是换行)
+				i++
+				continue
+			}
+			name := strings.ToLower(unescapeCSS(css[start:i]))
+			if char == '@' {
+				expectImport = name == "@import"
+				continue
+			}
+			if i >= len(css) || css[i] != '(' {
+				continue
+			}
+			// 函数
+			i++
+			if name == "url" {
+				valueStart, valueEnd, next, quoted, ok := scanCSSURL(css, i)
+				if quoted {
+					depth++
+					urlStringDepth = depth
+					continue
+				}
+				if ok {
+					replace(valueStart, valueEnd, css[valueStart:valueEnd], 0)
+				}
+				expectImport = false
+				i = next
+				continue
+			}
+			depth++
+			if name == "image-set" || name == "-webkit-image-set" {
+				imageSetDepths = append(imageSetDepths, depth)
+			}
+		case char == '(':
+			depth++
+			i++
+		case char == ')':
+			if len(imageSetDepths) > 0 && imageSetDepths[len(imageSetDepths)-1] == depth {
+				imageSetDepths = imageSetDepths[:len(imageSetDepths)-1]
+			}
+			if depth > 0 {
+				depth--
+			}
+			urlStringDepth = 0
+			i++
+		case char == ';' || char == '{' || char == '}':
+			expectImport = false
+			i++
+		default:
+			i++
+		}
+	}
+	if last == 0 {
+		return css
+	}
+	output.WriteString(css[last:])
+	return output.String()
+}
+
+// isCSSNameChar 标识符中可以出现的字符(不包括转义), 非ASCII字符都可以出现在标识符中
+func isCSSNameChar(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char >= '0' && char <= '9' ||
+		char == '-' || char == '_' || char >= 0x80
+}
+
+// isCSSSpace css中的空白字符
+func isCSSSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '\f'
+}
+
+// scanCSSName 从i开始读取标识符(包括转义字符), 返回标识符之后的位置
+func scanCSSName(css string, i int) int {
+	for i < len(css) {
+		if css[i] == '\\' {
+			if i+1 >= len(css) || css[i+1] == '\n' {
+				break
+			}
+			i = skipCSSEscape(css, i)
+			continue
+		}
+		if !isCSSNameChar(css[i]) {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// skipCSSEscape i为反斜线的位置, 返回转义序列之后的位置.
+// 十六进制转义最多6位, 之后的一个空白字符属于转义序列.
+func skipCSSEscape(css string, i int) int {
+	i++
+	if i >= len(css) {
+		return i
+	}
+	if !isHexDigit(css[i]) {
+		_, size := utf8.DecodeRuneInString(css[i:])
+		return i + size
+	}
+	for count := 0; count < 6 && i < len(css) && isHexDigit(css[i]); count++ {
+		i++
+	}
+	if i < len(css) && isCSSSpace(css[i]) {
+		if css[i] == '\r' && i+1 < len(css) && css[i+1] == '\n' {
+			i++
+		}
+		i++
+	}
+	return i
+}
+
+func isHexDigit(char byte) bool {
+	return char >= '0' && char <= '9' || char >= 'a' && char <= 'f' || char >= 'A' && char <= 'F'
+}
+
+// scanCSSString i为引号的位置, 返回字符串内容的范围[start, end)与字符串之后的位置.
+// 字符串中出现未转义的换行时, 是不完整的字符串(bad string), ok为false.
+func scanCSSString(css string, i int) (start int, end int, next int, ok bool) {
+	quote := css[i]
+	start = i + 1
+	j := start
+	for j < len(css) {
+		switch css[j] {
+		case quote:
+			end, next, ok = j, j+1, true
+			return
+		case '\n':
+			end, next = j, j
+			return
+		case '\\':
+			if j+1 < len(css) && (css[j+1] == '\n' || css[j+1] == '\f') {
+				j += 2
+			} else if j+2 < len(css) && css[j+1] == '\r' && css[j+2] == '\n' {
+				j += 3
+			} else {
+				j = skipCSSEscape(css, j)
+			}
+		default:
+			j++
+		}
+	}
+	// 到达文件末尾时字符串同样结束
+	end, next, ok = len(css), len(css), true
+	return
+}
+
+// scanCSSURL i为url(之后的位置, 读取不带引号的url.
+// url(之后(忽略空白)是引号时quoted为true, 由调用者作为函数处理其中的字符串.
+// 返回url内容的范围[valueStart, valueEnd)与右括号之后的位置; url中出现引号, 左括号等非法字符时ok为false(bad url).
+func scanCSSURL(css string, i int) (valueStart int, valueEnd int, next int, quoted bool, ok bool) {
+	for i < len(css) && isCSSSpace(css[i]) {
+		i++
+	}
+	if i < len(css) && (css[i] == '"' || css[i] == '\'') {
+		quoted = true
+		return
+	}
+	valueStart = i
+	for i < len(css) {
+		char := css[i]
+		switch {
+		case char == ')':
+			valueEnd, next, ok = i, i+1, valueStart < i
+			return
+		case isCSSSpace(char):
+			valueEnd = i
+			for i < len(css) && isCSSSpace(css[i]) {
+				i++
+			}
+			if i >= len(css) || css[i] == ')' {
+				next, ok = i+1, valueStart < valueEnd
+				if next > len(css) {
+					next = len(css)
+				}
+				return
+			}
+			next = skipBadCSSURL(css, i)
+			return
+		case char == '"' || char == '\'' || char == '(' || char < 0x20 || char == 0x7f:
+			next = skipBadCSSURL(css, i)
+			return
+		case char == '\\':
+			if i+1 < len(css) && css[i+1] == '\n' {
+				next = skipBadCSSURL(css, i)
+				return
+			}
+			i = skipCSSEscape(css, i)
+		default:
+			i++
+		}
+	}
+	// 到达文件末尾时url同样结束
+	valueEnd, next, ok = len(css), len(css), valueStart < len(css)
+	return
+}
+
+// skipBadCSSURL 跳过不合法的url直到右括号(包括)
+func skipBadCSSURL(css string, i int) int {
+	for i < len(css) {
+		if css[i] == ')' {
+			return i + 1
+		}
+		if css[i] == '\\' {
+			i = skipCSSEscape(css, i)
+			continue
+		}
+		i++
+	}
+	return i
+}
+
+// unescapeCSS 解码css中的转义字符, 如\28 -> (, \) -> ), 字符串中的\换行表示续行.
+func unescapeCSS(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var output strings.Builder
+	i := 0
+	for i < len(value) {
+		if value[i] != '\\' {
+			output.WriteByte(value[i])
+			i++
+			continue
+		}
+		if i+1 >= len(value) {
+			break
+		}
+		switch next := value[i+1]; {
+		case next == '\n' || next == '\f':
+			i += 2
+		case next == '\r':
+			i += 2
+			if i < len(value) && value[i] == '\n' {
+				i++
+			}
+		case isHexDigit(next):
+			end := skipCSSEscape(value, i)
+			digits := strings.TrimRightFunc(value[i+1:end], func(r rune) bool { return r < 0x80 && isCSSSpace(byte(r)) })
+			code, _ := strconv.ParseUint(digits, 16, 32)
+			if code == 0 || code > utf8.MaxRune || (code >= 0xd800 && code <= 0xdfff) {
+				output.WriteRune(utf8.RuneError)
+			} else {
+				output.WriteRune(rune(code))
+			}
+			i = end
+		default:
+			_, size := utf8.DecodeRuneInString(value[i+1:])
+			output.WriteString(value[i+1 : i+1+size])
+			i += 1 + size
+		}
+	}
+	return output.String()
+}
+
+// escapeCSSURL 转义替换后的url, quote为所在字符串的引号, 不带引号的url()中为0.
+func escapeCSSURL(value string, quote byte) string {
+	var output strings.Builder
+	for i := 0; i < len(value); i++ {
+		char := value[i]
+		switch {
+		case char == '\n' || char == '\r' || char == '\f':
+			output.WriteString("\\" + strconv.FormatInt(int64(char), 16) + " ")
+		case char == '\\':
+			output.WriteString("\\\\")
+		case quote != 0 && char == quote:
+			output.WriteString("\\" + string(char))
+		case quote == 0 && (char == '(' || char == ')' || char == '"' || char == '\'' || char == ' ' || char == '\t'):
+			output.WriteString("\\" + string(char))
+		default:
+			output.WriteByte(char)
+		}
+	}
+	return output.String()
+}
@@ -0,0 +1,241 @@
+package crawler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteCSSURLs(t *testing.T) {
+	tests := []struct {
+		name   string
+		css    string
+		urls   []string
+		output string
+	}{
+		{
+			name:   "url()",
+			css:    `a{background:url(a.png)} b{background:url( "b.png" )} c{background:url('c.png')}`,
+			urls:   []string{"a.png", "b.png", "c.png"},
+			output: `a{background:url(/x/a.png)} b{background:url( "/x/b.png" )} c{background:url('/x/c.png')}`,
+		},
+		{
+			name:   "url()前后的空白",
+			css:    "a{background:url(\n  a.png\t)}",
+			urls:   []string{"a.png"},
+			output: "a{background:url(\n  /x/a.png\t)}",
+		},
+		{
+			name:   "大写与转义的函数名",
+			css:    `a{background:URL(a.png)} b{background:u\72l(b.png)}`,
+			urls:   []string{"a.png", "b.png"},
+			output: `a{background:URL(/x/a.png)} b{background:u\72l(/x/b.png)}`,
+		},
+		{
+			name:   "rewrite不处理时保持不变",
+			css:    `a{background:url(keep.png)} b{background:url("keep.png")}`,
+			urls:   []string{"keep.png", "keep.png"},
+			output: `a{background:url(keep.png)} b{background:url("keep.png")}`,
+		},
+		{
+			name:   "十六进制转义",
+			css:    `a{background:url(a\28 1\29.png)} b{background:url(\2f b.png)}`,
+			urls:   []string{"a(1).png", "/b.png"},
+			output: `a{background:url(/x/a\(1\).png)} b{background:url(/x//b.png)}`,
+		},
+		{
+			name:   "字符转义",
+			css:    `a{background:url(a\).png)} b{background:url(b\ c.png)} c{background:url("c\"d.png")}`,
+			urls:   []string{"a).png", "b c.png", `c"d.png`},
+			output: `a{background:url(/x/a\).png)} b{background:url(/x/b\ c.png)} c{background:url("/x/c\"d.png")}`,
+		},
+		{
+			name:   "字符串中的续行",
+			css:    "a{background:url(\"a\\\nb.png\")}",
+			urls:   []string{"ab.png"},
+			output: `a{background:url("/x/ab.png")}`,
+		},
+		{
+			name:   "注释",
+			css:    `/* url(no.png) @import "no.css"; */ a{background:/* url(no2.png) */url(yes.png)}`,
+			urls:   []string{"yes.png"},
+			output: `/* url(no.png) @import "no.css"; */ a{background:/* url(no2.png) */url(/x/yes.png)}`,
+		},
+		{
+			name:   "未结束的注释",
+			css:    `a{background:url(a.png)} /* url(no.png)`,
+			urls:   []string{"a.png"},
+			output: `a{background:url(/x/a.png)} /* url(no.png)`,
+		},
+		{
+			name:   "字符串中的注释",
+			css:    `a{content:"/*"} b{background:url(b.png)} c{content:"*/"}`,
+			urls:   []string{"b.png"},
+			output: `a{content:"/*"} b{background:url(/x/b.png)} c{content:"*/"}`,
+		},
+		{
+			name:   "bad url",
+			css:    `a{background:url(a b.png)} b{background:url(a"b.png)} c{background:url(a(b.png)} d{background:url(ok.png)}`,
+			urls:   []string{"ok.png"},
+			output: `a{background:url(a b.png)} b{background:url(a"b.png)} c{background:url(a(b.png)} d{background:url(/x/ok.png)}`,
+		},
+		{
+			name:   "bad url中转义的右括号",
+			css:    `a{background:url(a b\).png)} d{background:url(ok.png)}`,
+			urls:   []string{"ok.png"},
+			output: `a{background:url(a b\).png)} d{background:url(/x/ok.png)}`,
+		},
+		{
+			name:   "空的url()",
+			css:    `a{background:url()} b{background:url(  )} c{background:url(ok.png)}`,
+			urls:   []string{"ok.png"},
+			output: `a{background:url()} b{background:url(  )} c{background:url(/x/ok.png)}`,
+		},
+		{
+			name:   "bad string",
+			css:    "a{content:\"abc\n} b{background:url(ok.png)}",
+			urls:   []string{"ok.png"},
+			output: "a{content:\"abc\n} b{background:url(/x/ok.png)}",
+		},
+		{
+			name:   "url()中的bad string",
+			css:    "a{background:url(\"a.png\n)} b{background:url(ok.png)}",
+			urls:   []string{"ok.png"},
+			output: "a{background:url(\"a.png\n)} b{background:url(/x/ok.png)}",
+		},
+		{
+			name:   "到达末尾时未结束的url",
+			css:    `a{background:url(a.png`,
+			urls:   []string{"a.png"},
+			output: `a{background:url(/x/a.png`,
+		},
+		{
+			name:   "@import",
+			css:    `@import "a.css"; @import 'b.css' screen; @IMPORT url(c.css) print; @import url("d.css");`,
+			urls:   []string{"a.css", "b.css", "c.css", "d.css"},
+			output: `@import "/x/a.css"; @import '/x/b.css' screen; @IMPORT url(/x/c.css) print; @import url("/x/d.css");`,
+		},
+		{
+			name:   "@import之后只有第一个字符串是url",
+			css:    `@import "a.css" supports(display: "grid"); a{content:"no.png"} @media print{b{content:"no2.png"}}`,
+			urls:   []string{"a.css"},
+			output: `@import "/x/a.css" supports(display: "grid"); a{content:"no.png"} @media print{b{content:"no2.png"}}`,
+		},
+		{
+			name:   "其他规则中的字符串",
+			css:    `@charset "utf-8"; @font-face{font-family:"Icon";src:url(a.woff2) format("woff2"),local("Arial")}`,
+			urls:   []string{"a.woff2"},
+			output: `@charset "utf-8"; @font-face{font-family:"Icon";src:url(/x/a.woff2) format("woff2"),local("Arial")}`,
+		},
+		{
+			name:   "image-set",
+			css:    `a{background:image-set("a.png" 1x, "b.png" 2x)} b{background:-webkit-image-set(url(c.png) 1x, 'd.png' 2x)}`,
+			urls:   []string{"a.png", "b.png", "c.png", "d.png"},
+			output: `a{background:image-set("/x/a.png" 1x, "/x/b.png" 2x)} b{background:-webkit-image-set(url(/x/c.png) 1x, '/x/d.png' 2x)}`,
+		},
+		{
+			name:   "image-set中嵌套的函数",
+			css:    `a{background:image-set("a.avif" type("image/avif") 1x, url("b.png") type("image/png"), "c.png" 2x)}`,
+			urls:   []string{"a.avif", "b.png", "c.png"},
+			output: `a{background:image-set("/x/a.avif" type("image/avif") 1x, url("/x/b.png") type("image/png"), "/x/c.png" 2x)}`,
+		},
+		{
+			name:   "其他函数中的image-set",
+			css:    `a{background:cross-fade(image-set("a.png" 1x), "no.png" 50%), linear-gradient(red, blue)} b{content:"no2.png"}`,
+			urls:   []string{"a.png"},
+			output: `a{background:cross-fade(image-set("/x/a.png" 1x), "no.png" 50%), linear-gradient(red, blue)} b{content:"no2.png"}`,
+		},
+		{
+			name:   "不是url的函数与标识符",
+			css:    `a{background:myurl(no.png)} b{font-family:url} c{background:url-x(no2.png)} d{background:x url(ok.png)}`,
+			urls:   []string{"ok.png"},
+			output: `a{background:myurl(no.png)} b{font-family:url} c{background:url-x(no2.png)} d{background:x url(/x/ok.png)}`,
+		},
+		{
+			name:   "非ASCII字符",
+			css:    `a{background:url(图片/背景.png)} b{content:"中文"}`,
+			urls:   []string{"图片/背景.png"},
+			output: `a{background:url(/x/图片/背景.png)} b{content:"中文"}`,
+		},
+	}
+	for _, test := range tests {
+		urls := []string{}
+		output := RewriteCSSURLs(test.css, func(rawURL string) (newURL string, ok bool) {
+			urls = append(urls, rawURL)
+			if strings.HasPrefix(rawURL, "keep") {
+				return
+			}
+			return "/x/" + rawURL, true
+		})
+		if !reflect.DeepEqual(urls, test.urls) {
+			t.Errorf("%s: 找到的url为%q, 应为%q", test.name, urls, test.urls)
+		}
+		if output != test.output {
+			t.Errorf("%s:\n输出为: %s\n应为:   %s", test.name, output, test.output)
+		}
+	}
+}
+
+// 替换后的url按照所在位置转义, 解码后与原值相同
+func TestRewriteCSSURLsEscaping(t *testing.T) {
+	newURL := "/a b(1)\"'\\.png"
+	tests := []struct {
+		css    string
+		output string
+	}{
+		{`a{background:url(a.png)}`, `a{background:url(/a\ b\(1\)\"\'\\.png)}`},
+		{`a{background:url("a.png")}`, `a{background:url("/a b(1)\"'\\.png")}`},
+		{`a{background:url('a.png')}`, `a{background:url('/a b(1)"\'\\.png')}`},
+		{`@import "a.png";`, `@import "/a b(1)\"'\\.png";`},
+	}
+	for _, test := range tests {
+		output := RewriteCSSURLs(test.css, func(rawURL string) (string, bool) {
+			return newURL, true
+		})
+		if output != test.output {
+			t.Errorf("RewriteCSSURLs(%s) = %s, 应为%s", test.css, output, test.output)
+		}
+		// 再次解析时得到的是替换后的原值
+		RewriteCSSURLs(output, func(rawURL string) (string, bool) {
+			if rawURL != newURL {
+				t.Errorf("%s中的url解码为%q, 应为%q", output, rawURL, newURL)
+			}
+			return "", false
+		})
+	}
+
+	// 换行等控制字符使用十六进制转义
+	if escaped := escapeCSSURL("a\nb", '"'); escaped != `a\a b` || unescapeCSS(escaped) != "a\nb" {
+		t.Errorf("escapeCSSURL(a\\nb) = %s", escaped)
+	}
+}
+
+func TestUnescapeCSS(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`a.png`, `a.png`},
+		{`a\28 1\29.png`, `a(1).png`},
+		{`\000041`, `A`},
+		{`\41 B`, `AB`},
+		{`\41  B`, `A B`},
+		{"\\41\r\nB", `AB`},
+		{`\4E2D\6587`, `中文`},
+		{`a\).png`, `a).png`},
+		{`a\\b`, `a\b`},
+		{`\中`, `中`},
+		{"a\\\nb", `ab`},
+		// 0, 代理区与超出范围的码点替换为U+FFFD
+		{`\0 a`, "\ufffda"},
+		{`\d800`, "\ufffd"},
+		{`\110000`, "\ufffd"},
+		// 末尾的反斜线忽略
+		{`a\`, `a`},
+	}
+	for _, test := range tests {
+		if got := unescapeCSS(test.value); got != test.want {
+			t.Errorf("unescapeCSS(%q) = %q, 应为%q", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package crawler
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+)
+
+// Frontier 待抓取任务的集合, 替代原来固定长度的channel队列.
+// 任务本身就存储在数据库的url_records表中, 入队列只是写入(或更新)一条init状态的记录,
+// 出队列则是取出最早的init状态记录并将其标记为pending. 内存中只维护各类型等待中的任务数量,
+// 所以入队列永远不会阻塞, 任务再多也不会占用更多内存.
+//
+// 同时Frontier负责判断抓取是否结束: 当所有类型都没有等待中的任务, 且没有worker正在处理任务时,
+// 由于只有worker在处理任务时才会产生新任务, 可以断定抓取已经完成.
+//
+// 入队列前会先检查url是否已经出现过, 已知的url直接丢弃, 不会重复抓取, 也不会再访问数据库.
+// 文档对url的引用关系不在这里记录, 而是由Crawler暂存在内存中, 每个文档解析完成后在一个事务中批量写入.
+// 例外是先作为静态资源出现, 之后又作为页面出现的url, 需要改为页面任务重新抓取并解析.
+//
+// 失败等待重试的任务同样是init状态, 但在next_attempt_at之前不会被取出. 只剩这样的任务时,
+// worker会等待到最早的重试时间, 抓取也不会被判断为结束.
+type Frontier struct {
+	dbClient      *gorm.DB
+	dbClientMutex *sync.Mutex
+
+	mutex *sync.Mutex
+	cond  *sync.Cond
+	// 各类型init状态的任务数量
+	queued map[int]int
+	// 已取出但还未处理完成的任务数量
+	inflight int
+	finished bool
+	// 从数据库中取出任务时出现的错误, 出错后所有worker都会退出
+	err error
+	// 已知url的集合, 只保存url的64位哈希值与任务类型, 以限制内存占用.
+	// 百万级url时哈希冲突的概率仍在千万分之一以下, 可以忽略.
+	seen map[uint64]int
+	// 正在作为静态资源处理, 处理完成后需要改为页面任务的url, 值为页面的深度
+	promotions map[string]int
+	// 已设置的定时唤醒时间, 用于等待重试任务, 为零值时没有定时器
+	wakeAt time.Time
+}
+
+// NewFrontier ...
+func NewFrontier(dbClient *gorm.DB, dbClientMutex *sync.Mutex) (frontier *Frontier) {
+	mutex := &sync.Mutex{}
+	frontier = &Frontier{
+		dbClient:      dbClient,
+		dbClientMutex: dbClientMutex,
+
+		mutex:      mutex,
+		cond:       sync.NewCond(mutex),
+		queued:     map[int]int{},
+		seen:       map[uint64]int{},
+		promotions: map[string]int{},
+	}
+	return
+}
+
+// Load 从数据库中加载上一次未完成的任务, 并用数据库中已有的url初始化已知url集合.
+// 上一次中断时处于pending状态的任务会被重置为init状态重新抓取.
+// update为true时重置所有记录的update状态, 且已知url集合从空开始, 以便重新遍历整个站点.
+func (frontier *Frontier) Load(update bool) (err error) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	frontier.dbClientMutex.Lock()
+	defer frontier.dbClientMutex.Unlock()
+
+	err = model.ResetPendingURLRecords(frontier.dbClient)
+	if err != nil {
+		return
+	}
+	if update {
+		err = model.ResetUpdateStates(frontier.dbClient)
+		if err != nil {
+			return
+		}
+	}
+	for _, urlType := range []int{model.URLTypePage, model.URLTypeAsset} {
+		var count int
+		count, err = model.CountQueuedURLRecords(frontier.dbClient, urlType)
+		if err != nil {
+			return
+		}
+		frontier.queued[urlType] = count
+	}
+	if update {
+		return
+	}
+	err = model.EachURL(frontier.dbClient, func(url string, urlType int) {
+		frontier.seen[hashURL(url)] = urlType
+	})
+	return
+}
+
+// Queued 返回指定类型等待中的任务数量
+func (frontier *Frontier) Queued(urlType int) int {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	return frontier.queued[urlType]
+}
+
+// Push 新任务入队列, 写入数据库记录后唤醒等待中的worker, 不会阻塞.
+// url已经出现过时直接丢弃, 返回的added为false; 但已有的是静态资源而req是页面时, 将已有记录改为页面任务.
+func (frontier *Frontier) Push(req *model.URLRecord) (added bool, err error) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+
+	key := hashURL(req.URL)
+	if urlType, exist := frontier.seen[key]; exist {
+		if urlType == model.URLTypeAsset && req.URLType == model.URLTypePage {
+			err = frontier.promote(req.URL, req.Depth)
+			if err == nil {
+				frontier.seen[key] = model.URLTypePage
+			}
+		}
+		return
+	}
+	err = frontier.push(req)
+	if err != nil {
+		return
+	}
+	frontier.seen[key] = req.URLType
+	added = true
+	return
+}
+
+// Retry 失败的任务重新入队列, 不检查url是否出现过.
+func (frontier *Frontier) Retry(req *model.URLRecord) (err error) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	return frontier.push(req)
+}
+
+// push 写入(或更新)数据库记录, 调用者需持有mutex.
+func (frontier *Frontier) push(req *model.URLRecord) (err error) {
+	frontier.dbClientMutex.Lock()
+	queued, err := model.AddOrUpdateURLRecord(frontier.dbClient, req)
+	frontier.dbClientMutex.Unlock()
+	if err != nil {
+		return
+	}
+	if queued {
+		frontier.queued[req.URLType]++
+		frontier.cond.Broadcast()
+	}
+	return
+}
+
+// promote 将静态资源记录改为页面任务重新入队列, 调用者需持有mutex.
+// 记录正在被处理时, 等到Done()时再修改, 否则worker最后写入的状态会覆盖init状态.
+func (frontier *Frontier) promote(url string, depth int) (err error) {
+	frontier.dbClientMutex.Lock()
+	status, err := model.PromoteURLRecord(frontier.dbClient, url, depth)
+	frontier.dbClientMutex.Unlock()
+	if gorm.IsRecordNotFoundError(err) {
+		// 哈希冲突, 实际是另一个url
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	switch status {
+	case model.URLTaskStatusPending:
+		frontier.promotions[url] = depth
+		return
+	case model.URLTaskStatusInit:
+		frontier.queued[model.URLTypeAsset]--
+	}
+	logger.Infof("静态资源同时被作为页面引用, 改为页面任务: %s", url)
+	frontier.queued[model.URLTypePage]++
+	frontier.cond.Broadcast()
+	return
+}
+
+// Pop 取出一个指定类型的任务, 没有可取的任务时阻塞等待.
+// 抓取结束, ctx被取消或数据库出错时返回nil, worker应当退出, 出错的原因可以通过Err()获取.
+// 每个成功取出的任务在处理完成后都必须调用Done().
+func (frontier *Frontier) Pop(ctx context.Context, urlType int) (req *model.URLRecord) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+
+	for {
+		if ctx.Err() != nil || frontier.finished || frontier.err != nil {
+			return nil
+		}
+		if frontier.queued[urlType] > 0 {
+			frontier.dbClientMutex.Lock()
+			task, err := model.PopURLRecord(frontier.dbClient, urlType, time.Now())
+			var nextAttemptAt *time.Time
+			if gorm.IsRecordNotFoundError(err) {
+				nextAttemptAt, err = model.QueryNextAttemptAt(frontier.dbClient, urlType)
+			}
+			frontier.dbClientMutex.Unlock()
+			if err == nil && task.ID != 0 {
+				frontier.queued[urlType]--
+				frontier.inflight++
+				return task
+			}
+			if err == nil && nextAttemptAt != nil {
+				// 剩下的任务都还没到重试时间
+				frontier.wakeUpAt(*nextAttemptAt)
+				frontier.cond.Wait()
+				continue
+			}
+			if err == nil {
+				// 计数与数据库不一致(如记录被外部修改), 以数据库为准.
+				frontier.queued[urlType] = 0
+				frontier.checkFinished()
+				continue
+			}
+			// 数据库出错时不能认为任务为空, 否则可能提前结束.
+			// 记录错误并唤醒其他worker一起退出, 由Run()返回错误.
+			logger.Errorf("从数据库中取出任务失败: url type: %d, error: %s", urlType, err.Error())
+			frontier.err = err
+			frontier.cond.Broadcast()
+			return nil
+		}
+		frontier.checkFinished()
+		if frontier.finished {
+			return nil
+		}
+		frontier.cond.Wait()
+	}
+}
+
+// Done 任务处理完成(包括其中解析出的新任务入队列)后调用.
+// 处理期间被作为页面引用的静态资源, 在这里改为页面任务.
+func (frontier *Frontier) Done(req *model.URLRecord) {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	if depth, exist := frontier.promotions[req.URL]; exist {
+		delete(frontier.promotions, req.URL)
+		err := frontier.promote(req.URL, depth)
+		if err != nil {
+			logger.Errorf("静态资源改为页面任务失败: req: %+v, error: %s", req, err.Error())
+		}
+	}
+	frontier.inflight--
+	frontier.checkFinished()
+}
+
+// Wake 唤醒所有等待中的worker, 用于ctx被取消时让worker及时退出.
+func (frontier *Frontier) Wake() {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	frontier.cond.Broadcast()
+}
+
+// Finished 抓取是否已经结束
+func (frontier *Frontier) Finished() bool {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	frontier.checkFinished()
+	return frontier.finished
+}
+
+// Err 返回从数据库中取出任务时出现的错误
+func (frontier *Frontier) Err() error {
+	frontier.mutex.Lock()
+	defer frontier.mutex.Unlock()
+	return frontier.err
+}
+
+// wakeUpAt 在指定时间唤醒所有等待中的worker, 已有更早的定时器时不重复设置. 调用者需持有mutex.
+func (frontier *Frontier) wakeUpAt(at time.Time) {
+	now := time.Now()
+	if !frontier.wakeAt.IsZero() && frontier.wakeAt.After(now) && !frontier.wakeAt.After(at) {
+		return
+	}
+	frontier.wakeAt = at
+	time.AfterFunc(at.Sub(now), func() {
+		frontier.mutex.Lock()
+		defer frontier.mutex.Unlock()
+		if frontier.wakeAt.Equal(at) {
+			frontier.wakeAt = time.Time{}
+		}
+		frontier.cond.Broadcast()
+	})
+}
+
+// hashURL 计算url的64位FNV-1a哈希值
+func hashURL(url string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(url))
+	return hash.Sum64()
+}
+
+// checkFinished 没有等待中和处理中的任务时标记为结束, 并唤醒所有worker退出. 调用者需持有mutex.
+func (frontier *Frontier) checkFinished() {
+	if frontier.finished || frontier.inflight > 0 {
+		return
+	}
+	for _, count := range frontier.queued {
+		if count > 0 {
+			return
+		}
+	}
+	frontier.finished = true
+	frontier.cond.Broadcast()
+}
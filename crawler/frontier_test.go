@@ -0,0 +1,205 @@
+package crawler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+	"gitee.com/generals-space/site-mirror-go.git/util"
+)
+
+// newTestFrontier 在临时目录中创建数据库与Frontier, 返回清理函数
+func newTestFrontier(t *testing.T) (frontier *Frontier, dbClient *gorm.DB, cleanup func()) {
+	logger = util.NewLogger(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "frontier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbClient, err = model.GetDB(filepath.Join(dir, "site.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	frontier = NewFrontier(dbClient, &sync.Mutex{})
+	cleanup = func() {
+		dbClient.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func pushTask(t *testing.T, frontier *Frontier, url string, urlType int) (added bool) {
+	added, err := frontier.Push(&model.URLRecord{URL: url, URLType: urlType, Depth: 2, LocalPath: "/" + filepath.Base(url)})
+	if err != nil {
+		t.Fatalf("Push(%s): %s", url, err)
+	}
+	return
+}
+
+func queryTask(t *testing.T, dbClient *gorm.DB, url string) (task *model.URLRecord) {
+	task = &model.URLRecord{}
+	err := dbClient.Where("url = ?", url).First(task).Error
+	if err != nil {
+		t.Fatalf("查询记录失败: %s, %s", url, err)
+	}
+	return
+}
+
+func TestFrontierPushSkipsSeenURL(t *testing.T) {
+	frontier, _, cleanup := newTestFrontier(t)
+	defer cleanup()
+
+	if !pushTask(t, frontier, "http://example.com/a.html", model.URLTypePage) {
+		t.Fatal("新url应当入队列")
+	}
+	if pushTask(t, frontier, "http://example.com/a.html", model.URLTypePage) {
+		t.Error("已知的url不应当重复入队列")
+	}
+	if pushTask(t, frontier, "http://example.com/a.html", model.URLTypeAsset) {
+		t.Error("已作为页面的url不应当再作为静态资源入队列")
+	}
+	if queued := frontier.Queued(model.URLTypePage); queued != 1 {
+		t.Errorf("页面任务数量为%d, 应为1", queued)
+	}
+	if queued := frontier.Queued(model.URLTypeAsset); queued != 0 {
+		t.Errorf("静态资源任务数量为%d, 应为0", queued)
+	}
+}
+
+// 等待中的静态资源又作为页面出现, 直接改为页面任务
+func TestFrontierPromotesQueuedAsset(t *testing.T) {
+	frontier, _, cleanup := newTestFrontier(t)
+	defer cleanup()
+
+	url := "http://example.com/next"
+	pushTask(t, frontier, url, model.URLTypeAsset)
+	pushTask(t, frontier, url, model.URLTypePage)
+
+	if queued := frontier.Queued(model.URLTypeAsset); queued != 0 {
+		t.Errorf("静态资源任务数量为%d, 应为0", queued)
+	}
+	if queued := frontier.Queued(model.URLTypePage); queued != 1 {
+		t.Fatalf("页面任务数量为%d, 应为1", queued)
+	}
+	req := frontier.Pop(context.Background(), model.URLTypePage)
+	if req == nil || req.URL != url || req.URLType != model.URLTypePage {
+		t.Fatalf("应当取出页面任务%s, 实际为%+v", url, req)
+	}
+	if req.LocalPath != "/next" {
+		t.Errorf("改为页面任务后本地链接应保持不变, 实际为%s", req.LocalPath)
+	}
+	frontier.Done(req)
+	if !frontier.Finished() {
+		t.Error("所有任务处理完成后应当结束")
+	}
+}
+
+// 已经作为静态资源抓取成功的url又在之后解析的页面中作为页面出现, 需要重新抓取并解析
+func TestFrontierPromotesFinishedAsset(t *testing.T) {
+	frontier, dbClient, cleanup := newTestFrontier(t)
+	defer cleanup()
+
+	url := "http://example.com/next"
+	pushTask(t, frontier, "http://example.com/b.html", model.URLTypePage)
+	pushTask(t, frontier, url, model.URLTypeAsset)
+	asset := frontier.Pop(context.Background(), model.URLTypeAsset)
+	if asset == nil {
+		t.Fatal("应当取出静态资源任务")
+	}
+	err := model.UpdateURLRecordStatus(dbClient, url, model.URLTaskStatusSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontier.Done(asset)
+
+	// 正在解析的页面中引用了这个url
+	page := frontier.Pop(context.Background(), model.URLTypePage)
+	if page == nil {
+		t.Fatal("应当取出页面任务")
+	}
+	pushTask(t, frontier, url, model.URLTypePage)
+	task := queryTask(t, dbClient, url)
+	if task.URLType != model.URLTypePage || task.Status != model.URLTaskStatusInit {
+		t.Fatalf("记录应改为init状态的页面任务, 实际为type: %d, status: %d", task.URLType, task.Status)
+	}
+	frontier.Done(page)
+
+	req := frontier.Pop(context.Background(), model.URLTypePage)
+	if req == nil || req.URL != url {
+		t.Fatalf("应当取出页面任务%s, 实际为%+v", url, req)
+	}
+	frontier.Done(req)
+	if !frontier.Finished() {
+		t.Error("所有任务处理完成后应当结束")
+	}
+}
+
+// 正在处理的静态资源又作为页面出现, 等处理完成后再改为页面任务, 不能被worker写入的状态覆盖
+func TestFrontierPromotesInflightAsset(t *testing.T) {
+	frontier, dbClient, cleanup := newTestFrontier(t)
+	defer cleanup()
+
+	url := "http://example.com/next"
+	pushTask(t, frontier, url, model.URLTypeAsset)
+	req := frontier.Pop(context.Background(), model.URLTypeAsset)
+	if req == nil {
+		t.Fatal("应当取出静态资源任务")
+	}
+
+	pushTask(t, frontier, url, model.URLTypePage)
+	if task := queryTask(t, dbClient, url); task.URLType != model.URLTypeAsset {
+		t.Fatal("处理中的记录不应立即修改")
+	}
+	err := model.UpdateURLRecordStatus(dbClient, url, model.URLTaskStatusSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frontier.Done(req)
+	if frontier.Finished() {
+		t.Fatal("改为页面任务后不应结束")
+	}
+
+	req = frontier.Pop(context.Background(), model.URLTypePage)
+	if req == nil || req.URL != url || req.URLType != model.URLTypePage {
+		t.Fatalf("应当取出页面任务%s, 实际为%+v", url, req)
+	}
+	if req.Depth != 2 {
+		t.Errorf("页面深度为%d, 应为2", req.Depth)
+	}
+	frontier.Done(req)
+	if !frontier.Finished() {
+		t.Error("所有任务处理完成后应当结束")
+	}
+}
+
+// 继续抓取时从数据库中加载已知url与其类型, 之前的静态资源同样可以改为页面任务
+func TestFrontierLoadKeepsURLType(t *testing.T) {
+	frontier, dbClient, cleanup := newTestFrontier(t)
+	defer cleanup()
+
+	url := "http://example.com/next"
+	pushTask(t, frontier, url, model.URLTypeAsset)
+	err := model.UpdateURLRecordStatus(dbClient, url, model.URLTaskStatusSuccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frontier = NewFrontier(dbClient, &sync.Mutex{})
+	err = frontier.Load(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushTask(t, frontier, url, model.URLTypeAsset) {
+		t.Error("已知的静态资源不应重复入队列")
+	}
+	pushTask(t, frontier, url, model.URLTypePage)
+	if queued := frontier.Queued(model.URLTypePage); queued != 1 {
+		t.Errorf("页面任务数量为%d, 应为1", queued)
+	}
+}
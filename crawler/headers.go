@@ -0,0 +1,58 @@
+package crawler
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// HeaderRule 只对url匹配Pattern的请求设置的请求头
+type HeaderRule struct {
+	// 匹配完整url的正则
+	Pattern string            `json:"pattern"`
+	Headers map[string]string `json:"headers"`
+}
+
+// headerRule 编译后的HeaderRule
+type headerRule struct {
+	pattern *regexp.Regexp
+	headers map[string]string
+}
+
+// compileHeaderRules 编译请求头规则, 规则中的正则需要已经通过校验.
+func compileHeaderRules(rules []*HeaderRule) (compiled []*headerRule) {
+	for _, rule := range rules {
+		compiled = append(compiled, &headerRule{
+			pattern: regexp.MustCompile(rule.Pattern),
+			headers: rule.Headers,
+		})
+	}
+	return
+}
+
+// setHeaders 设置配置中的额外请求头, 先设置全局的Headers, 再按顺序应用匹配的HeaderRules,
+// 后设置的同名请求头覆盖之前的值, 也会覆盖默认的User-Agent与Referer.
+func (crawler *Crawler) setHeaders(req *http.Request) {
+	for key, value := range crawler.Config.Headers {
+		req.Header.Set(key, value)
+	}
+	fullURL := req.URL.String()
+	for _, rule := range crawler.headerRules {
+		if !rule.pattern.MatchString(fullURL) {
+			continue
+		}
+		for key, value := range rule.headers {
+			req.Header.Set(key, value)
+		}
+	}
+}
+
+// userAgentFor 为url选择User-Agent.
+// 配置了UserAgents时按url的哈希值从中选取, 同一url(包括重试)总是使用同一个User-Agent,
+// 不同的url则分散到各个User-Agent上; 否则使用UserAgent.
+func (crawler *Crawler) userAgentFor(url string) string {
+	userAgents := crawler.Config.UserAgents
+	if len(userAgents) == 0 {
+		return crawler.Config.UserAgent
+	}
+	return userAgents[hashURL(url)%uint64(len(userAgents))]
+}
@@ -0,0 +1,155 @@
+package crawler
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// HostLimit 单个站点的请求限制, 各项为0时表示不限制.
+type HostLimit struct {
+	// 匹配主机名(带端口)的正则, 只在HostLimits规则中使用
+	Pattern string `json:"pattern"`
+	// 同时进行的最大请求数
+	MaxConns int `json:"max_conns"`
+	// 两次请求之间的最小间隔, 单位秒
+	Delay float64 `json:"delay"`
+	// 令牌桶限速, 每秒请求数与桶容量(允许的突发请求数), Burst为0时视为1
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// hostState 单个主机的限流状态
+type hostState struct {
+	limit *HostLimit
+	// 容量为MaxConns的信号量, MaxConns为0时为nil
+	conns chan struct{}
+	// 令牌桶中的剩余令牌与上次计算的时间
+	tokens    float64
+	tokenTime time.Time
+	// 下一次允许请求的时间, 用于实现最小间隔
+	nextRequestAt time.Time
+}
+
+// HostScheduler 按主机限制请求的并发数与频率.
+// 每个主机(包括站外资源所在的主机)有各自独立的限流状态, 所有worker共享,
+// 这样即使所有worker同时取到同一个CDN上的资源, 也不会超出该主机的限制.
+type HostScheduler struct {
+	defaultLimit *HostLimit
+	rules        []*HostLimit
+	patterns     []*regexp.Regexp
+
+	mutex *sync.Mutex
+	hosts map[string]*hostState
+}
+
+// NewHostScheduler 创建主机调度器, rules中的Pattern需要已经通过校验.
+func NewHostScheduler(defaultLimit *HostLimit, rules []*HostLimit) (scheduler *HostScheduler) {
+	scheduler = &HostScheduler{
+		defaultLimit: defaultLimit,
+		rules:        rules,
+		mutex:        &sync.Mutex{},
+		hosts:        map[string]*hostState{},
+	}
+	for _, rule := range rules {
+		scheduler.patterns = append(scheduler.patterns, regexp.MustCompile(rule.Pattern))
+	}
+	return
+}
+
+// limitFor 按顺序查找第一个匹配的规则, 都不匹配时使用默认限制.
+func (scheduler *HostScheduler) limitFor(host string) *HostLimit {
+	for i, pattern := range scheduler.patterns {
+		if pattern.MatchString(host) {
+			return scheduler.rules[i]
+		}
+	}
+	return scheduler.defaultLimit
+}
+
+// state 获取主机的限流状态, 调用者需持有mutex.
+func (scheduler *HostScheduler) state(host string) *hostState {
+	state, exist := scheduler.hosts[host]
+	if exist {
+		return state
+	}
+	limit := scheduler.limitFor(host)
+	state = &hostState{limit: limit}
+	if limit.MaxConns > 0 {
+		state.conns = make(chan struct{}, limit.MaxConns)
+	}
+	if limit.RPS > 0 {
+		state.tokens = float64(burstOf(limit))
+		state.tokenTime = time.Now()
+	}
+	scheduler.hosts[host] = state
+	return state
+}
+
+func burstOf(limit *HostLimit) int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return 1
+}
+
+// Acquire 等待到允许向host发起请求, 请求完成(响应体读取完毕)后需要调用返回的release.
+// extraDelay为额外要求的最小间隔(如robots.txt中的Crawl-delay), 与配置的间隔取较大值.
+// ctx被取消时返回ctx.Err(), 此时不需要调用release.
+func (scheduler *HostScheduler) Acquire(ctx context.Context, host string, extraDelay time.Duration) (release func(), err error) {
+	scheduler.mutex.Lock()
+	state := scheduler.state(host)
+	scheduler.mutex.Unlock()
+
+	release = func() {}
+	if state.conns != nil {
+		select {
+		case state.conns <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		release = func() { <-state.conns }
+	}
+
+	// 预留一个请求时间点, 多个worker并发请求同一主机时会依次间隔开.
+	scheduler.mutex.Lock()
+	now := time.Now()
+	requestAt := now
+	if state.limit.RPS > 0 {
+		burst := float64(burstOf(state.limit))
+		state.tokens += now.Sub(state.tokenTime).Seconds() * state.limit.RPS
+		if state.tokens > burst {
+			state.tokens = burst
+		}
+		state.tokenTime = now
+		state.tokens--
+		if state.tokens < 0 {
+			requestAt = now.Add(time.Duration(-state.tokens / state.limit.RPS * float64(time.Second)))
+		}
+	}
+	if requestAt.Before(state.nextRequestAt) {
+		requestAt = state.nextRequestAt
+	}
+	delay := time.Duration(state.limit.Delay * float64(time.Second))
+	if delay < extraDelay {
+		delay = extraDelay
+	}
+	state.nextRequestAt = requestAt.Add(delay)
+	scheduler.mutex.Unlock()
+
+	if !requestAt.After(now) {
+		return
+	}
+	timer := time.NewTimer(requestAt.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		release()
+		release = nil
+		err = ctx.Err()
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 连续请求同一主机时, 按令牌桶与最小间隔依次间隔开
+func TestHostSchedulerInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      *HostLimit
+		extraDelay time.Duration
+		count      int
+		// 所有请求完成所需的最短时间
+		elapsed time.Duration
+	}{
+		{"不限制", &HostLimit{}, 0, 5, 0},
+		{"令牌桶, 桶中的令牌可以立即使用", &HostLimit{RPS: 20, Burst: 3}, 0, 3, 0},
+		{"令牌桶, 之后每秒RPS个请求", &HostLimit{RPS: 20, Burst: 2}, 0, 6, 200 * time.Millisecond},
+		{"Burst为0时视为1", &HostLimit{RPS: 20}, 0, 4, 150 * time.Millisecond},
+		{"最小间隔", &HostLimit{Delay: 0.05}, 0, 4, 150 * time.Millisecond},
+		{"Crawl-delay更长时以其为准", &HostLimit{Delay: 0.01}, 60 * time.Millisecond, 3, 120 * time.Millisecond},
+		{"最小间隔更长时以其为准", &HostLimit{Delay: 0.06}, 10 * time.Millisecond, 3, 120 * time.Millisecond},
+		{"令牌桶与最小间隔同时生效", &HostLimit{RPS: 100, Burst: 5, Delay: 0.04}, 0, 4, 120 * time.Millisecond},
+	}
+	for _, test := range tests {
+		scheduler := NewHostScheduler(test.limit, nil)
+		start := time.Now()
+		for i := 0; i < test.count; i++ {
+			release, err := scheduler.Acquire(context.Background(), "example.com", test.extraDelay)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			release()
+		}
+		elapsed := time.Since(start)
+		// 允许一定的调度误差, 但不能明显快于限制, 也不能多等一个间隔以上
+		if elapsed < test.elapsed-10*time.Millisecond || elapsed > test.elapsed+100*time.Millisecond {
+			t.Errorf("%s: %d个请求用时%s, 应约为%s", test.name, test.count, elapsed, test.elapsed)
+		}
+	}
+}
+
+// 每个主机的限流状态相互独立, 按顺序匹配的第一条规则生效
+func TestHostSchedulerRules(t *testing.T) {
+	scheduler := NewHostScheduler(&HostLimit{Delay: 10}, []*HostLimit{
+		{Pattern: `^cdn\.`, MaxConns: 1},
+		{Pattern: `example`, Delay: 20},
+	})
+	tests := []struct {
+		host  string
+		limit *HostLimit
+	}{
+		{"cdn.example.com", scheduler.rules[0]},
+		{"www.example.com", scheduler.rules[1]},
+		{"other.com:8080", scheduler.defaultLimit},
+	}
+	for _, test := range tests {
+		if limit := scheduler.limitFor(test.host); limit != test.limit {
+			t.Errorf("limitFor(%s) = %+v, 应为%+v", test.host, limit, test.limit)
+		}
+	}
+
+	// 第一个请求不需要等待, 不同主机之间互不影响
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for _, host := range []string{"a.com", "b.com", "www.example.com", "cdn.example.com"} {
+		release, err := scheduler.Acquire(ctx, host, 0)
+		if err != nil {
+			t.Fatalf("Acquire(%s): %s", host, err)
+		}
+		release()
+	}
+}
+
+// 同时进行的请求数达到MaxConns时等待其他请求release
+func TestHostSchedulerMaxConns(t *testing.T) {
+	scheduler := NewHostScheduler(&HostLimit{MaxConns: 2}, nil)
+	releases := []func(){}
+	for i := 0; i < 2; i++ {
+		release, err := scheduler.Acquire(context.Background(), "example.com", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+
+	// 其他主机不受影响
+	release, err := scheduler.Acquire(context.Background(), "other.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	_, err = scheduler.Acquire(ctx, "example.com", 0)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("连接数已满时Acquire()应等待到ctx超时, 实际为%v", err)
+	}
+
+	acquired := make(chan func(), 1)
+	go func() {
+		release, err := scheduler.Acquire(context.Background(), "example.com", 0)
+		if err != nil {
+			t.Error(err)
+			release = func() {}
+		}
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("连接数已满时不应取得连接")
+	case <-time.After(30 * time.Millisecond):
+	}
+	releases[0]()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("release之后应取得连接")
+	}
+	releases[1]()
+	if n := len(scheduler.hosts["example.com"].conns); n != 0 {
+		t.Errorf("全部release后占用的连接数为%d", n)
+	}
+}
+
+// 等待请求间隔时被取消, 立即返回并释放已占用的连接
+func TestHostSchedulerCancel(t *testing.T) {
+	scheduler := NewHostScheduler(&HostLimit{MaxConns: 2, Delay: 10}, nil)
+	release, err := scheduler.Acquire(context.Background(), "example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	secondRelease, err := scheduler.Acquire(ctx, "example.com", 0)
+	if err != context.Canceled || secondRelease != nil {
+		t.Fatalf("被取消时Acquire() = %v, 应为context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("被取消后%s才返回", elapsed)
+	}
+	if n := len(scheduler.hosts["example.com"].conns); n != 1 {
+		t.Errorf("被取消后占用的连接数为%d, 应为1", n)
+	}
+
+	// 已经取消的ctx同样立即返回
+	_, err = scheduler.Acquire(ctx, "example.com", 0)
+	if err != context.Canceled {
+		t.Errorf("ctx已取消时Acquire() = %v, 应为context.Canceled", err)
+	}
+}
@@ -0,0 +1,103 @@
+package crawler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// readTimeoutConn 每次读取前设置读超时, 连接在ReadTimeout时间内没有收到任何数据时读取失败.
+// 与http.Client.Timeout限制整个请求的时长不同, 这里限制的是服务端"卡住"不发数据的时长.
+// 连接池中的空闲连接同样受此限制, 空闲超过ReadTimeout后会被关闭.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *readTimeoutConn) Read(b []byte) (n int, err error) {
+	err = conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	if err != nil {
+		return
+	}
+	return conn.Conn.Read(b)
+}
+
+// NewHTTPClient 按照配置创建所有请求共享的http客户端, 复用连接池.
+func NewHTTPClient(config *Config) (client *http.Client, err error) {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(config.ConnectTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	readTimeout := time.Duration(config.ReadTimeout) * time.Second
+	dialContext := dialer.DialContext
+	if readTimeout > 0 {
+		dialContext = func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+			conn, err = dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return
+			}
+			conn = &readTimeoutConn{Conn: conn, timeout: readTimeout}
+			return
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		var content []byte
+		content, err = ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			err = fmt.Errorf("读取CA证书失败: %s, %s", config.CAFile, err.Error())
+			return
+		}
+		// 在系统证书的基础上追加, 获取系统证书失败时只使用指定的证书
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			err = fmt.Errorf("CA证书文件中没有可用的PEM证书: %s", config.CAFile)
+			return
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// 未指定代理时使用HTTP_PROXY, HTTPS_PROXY等环境变量, socks5代理由标准库直接支持.
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		var proxyURL *url.URL
+		proxyURL, err = url.Parse(config.Proxy)
+		if err != nil {
+			err = fmt.Errorf("代理地址不合法: %s, %s", config.Proxy, err.Error())
+			return
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	// 不使用标准库透明的gzip解压, 由getURL自行发送Accept-Encoding并在读取后解码,
+	// 这样WARC中记录的是服务端实际发送的原始响应体与Content-Encoding响应头.
+	transport := &http.Transport{
+		DisableCompression:    true,
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(config.ConnectTimeout) * time.Second,
+		ResponseHeaderTimeout: readTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(config.IdleConnTimeout) * time.Second,
+	}
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(config.RequestTimeout) * time.Second,
+	}
+	return
+}
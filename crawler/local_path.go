@@ -0,0 +1,381 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// 常见媒体类型对应的扩展名. mime.ExtensionsByType返回的列表按字母排序,
+// 如image/jpeg的第一个是.jfif, 所以常见类型需要指定.
+var preferredExtensions = map[string]string{
+	"text/html":                     ".html",
+	"application/xhtml+xml":         ".xhtml",
+	"text/css":                      ".css",
+	"text/javascript":               ".js",
+	"application/javascript":        ".js",
+	"application/x-javascript":      ".js",
+	"application/json":              ".json",
+	"text/xml":                      ".xml",
+	"application/xml":               ".xml",
+	"image/jpeg":                    ".jpg",
+	"image/png":                     ".png",
+	"image/gif":                     ".gif",
+	"image/webp":                    ".webp",
+	"image/bmp":                     ".bmp",
+	"image/svg+xml":                 ".svg",
+	"image/x-icon":                  ".ico",
+	"image/vnd.microsoft.icon":      ".ico",
+	"image/avif":                    ".avif",
+	"font/woff":                     ".woff",
+	"font/woff2":                    ".woff2",
+	"font/ttf":                      ".ttf",
+	"font/otf":                      ".otf",
+	"application/font-woff":         ".woff",
+	"application/font-woff2":        ".woff2",
+	"application/vnd.ms-fontobject": ".eot",
+	"application/pdf":               ".pdf",
+	"application/zip":               ".zip",
+	"video/mp4":                     ".mp4",
+	"audio/mpeg":                    ".mp3",
+}
+
+// extensionOfMediaType 媒体类型对应的扩展名, 无法确定时返回空字符串.
+// octet-stream, text/plain等笼统的类型不能说明实际类型, 同样返回空字符串.
+func extensionOfMediaType(mediaType string) string {
+	if genericMediaTypes[mediaType] {
+		return ""
+	}
+	if ext, exist := preferredExtensions[mediaType]; exist {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// withMediaTypeExtension 本地链接的扩展名与媒体类型不符时(如/avatar?id=5被转换为/avatarwhid=5),
+// 追加媒体类型对应的扩展名, 否则nginx等静态服务器只能以application/octet-stream返回.
+// 扩展名与媒体类型属于同一类资源时(如.jpeg与image/png)保持不变.
+func withMediaTypeExtension(localLink string, mediaType string) string {
+	ext := extensionOfMediaType(mediaType)
+	if ext == "" || strings.ToLower(path.Ext(localLink)) == ext {
+		return localLink
+	}
+	resource := resourceOfMediaType(mediaType)
+	if resource != ResourceOther && ClassifyURL(localLink) == resource {
+		return localLink
+	}
+	if resource == ResourceOther {
+		if currentType := mime.TypeByExtension(path.Ext(localLink)); currentType != "" {
+			currentType, _, err := mime.ParseMediaType(currentType)
+			if err == nil && currentType == mediaType {
+				return localLink
+			}
+		}
+	}
+	return localLink + ext
+}
+
+// storedLocalLink 根据响应的实际类型确定存储用的本地链接, 与入队列时分配的本地链接不同时更新记录.
+// html页面仍然使用入队列时分配的链接; 页面链接指向的不是html时去掉追加的.html后缀;
+// 扩展名与实际类型不符时追加对应的扩展名.
+func (crawler *Crawler) storedLocalLink(req *model.URLRecord, resource string, mediaType string) (localLink string, err error) {
+	localLink, err = crawler.localLinkOf(req)
+	if err != nil {
+		return
+	}
+	if req.URLType == model.URLTypePage && resource == ResourceHTML {
+		return
+	}
+	candidate := req.OriginLocalPath
+	if candidate == "" {
+		candidate = localLink
+	}
+	if req.URLType == model.URLTypePage && strings.HasSuffix(candidate, ".html") && !htmlURLPattern.MatchString(urlPathOf(req.URL)) {
+		candidate = strings.TrimSuffix(candidate, ".html")
+	}
+	candidate = withMediaTypeExtension(candidate, mediaType)
+	if candidate == localLink {
+		return
+	}
+	crawler.DBClientMutex.Lock()
+	localLink, err = model.RelocateLocalPath(crawler.DBClient, req.URL, candidate)
+	crawler.DBClientMutex.Unlock()
+	return
+}
+
+// localLinkOf 任务的本地链接, 取出的任务中没有记录时查询数据库.
+func (crawler *Crawler) localLinkOf(req *model.URLRecord) (localLink string, err error) {
+	if req.LocalPath != "" {
+		localLink = req.LocalPath
+		return
+	}
+	localLink, err = crawler.LookupLocalLink(req.URL, req.URLType)
+	return
+}
+
+// LookupLocalLink 查询url对应的本地链接, 页面, css中的链接改写与文件存储都以此为准.
+// url应当已经入队列(入队列时分配本地链接), 没有记录时(如入库失败)按TransToLocalLink的规则转换.
+func (crawler *Crawler) LookupLocalLink(fullURL string, urlType int) (localLink string, err error) {
+	crawler.DBClientMutex.Lock()
+	localLink, err = model.QueryLocalPath(crawler.DBClient, fullURL)
+	crawler.DBClientMutex.Unlock()
+	if err == nil && localLink != "" {
+		return
+	}
+	localLink, err = TransToLocalLink(crawler.Config.MainSite, fullURL, urlType)
+	return
+}
+
+// linkFrom 返回req对应的文档(页面或css)中指向fullURL的链接, 用于改写文档中的链接属性.
+// 默认为以/起始的本地链接, 开启RelativeLinks时为相对于文档所在目录的相对路径.
+func (crawler *Crawler) linkFrom(req *model.URLRecord, fullURL string, urlType int) (link string, err error) {
+	link, err = crawler.LookupLocalLink(fullURL, urlType)
+	if err != nil || !crawler.Config.RelativeLinks {
+		return
+	}
+	// 存储时只会修改文件名(追加扩展名或哈希值), 文档所在目录不变, 因此可以在存储前计算相对路径
+	docLink, err := crawler.localLinkOf(req)
+	if err != nil {
+		return
+	}
+	link = relativeLocalLink(docLink, link)
+	return
+}
+
+// relativeLocalLink 计算从本地链接from所在目录指向本地链接to的相对路径,
+// 如/a/b/index.html -> /a/c.css为../c.css, /index.html -> /cdn.example.com/x.js为cdn.example.com/x.js.
+func relativeLocalLink(from string, to string) (link string) {
+	fromDirs := strings.Split(strings.Trim(path.Dir(from), "/"), "/")
+	if fromDirs[0] == "" {
+		fromDirs = nil
+	}
+	toParts := strings.Split(strings.TrimPrefix(to, "/"), "/")
+	common := 0
+	for common < len(fromDirs) && common < len(toParts)-1 && fromDirs[common] == toParts[common] {
+		common++
+	}
+	parts := []string{}
+	for i := common; i < len(fromDirs); i++ {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, toParts[common:]...)
+	link = strings.Join(parts, "/")
+	// 第一段中含有冒号时(如/wiki/File:a.png)会被浏览器当作协议, 需要以./起始
+	if strings.Contains(parts[0], ":") {
+		link = "./" + link
+	}
+	return
+}
+
+// defaultLocalLink 新任务入队列前设置默认的本地链接, 入库时与已有记录冲突会被修改.
+func (crawler *Crawler) defaultLocalLink(req *model.URLRecord) (err error) {
+	if req.LocalPath != "" {
+		return
+	}
+	req.LocalPath, err = TransToLocalLink(crawler.Config.MainSite, req.URL, req.URLType)
+	return
+}
+
+// assignMissingLocalPaths 为旧版本数据库中没有本地链接的记录分配本地链接.
+func (crawler *Crawler) assignMissingLocalPaths() (err error) {
+	crawler.DBClientMutex.Lock()
+	defer crawler.DBClientMutex.Unlock()
+	tasks, err := model.QueryURLRecordsWithoutLocalPath(crawler.DBClient)
+	if err != nil || len(tasks) == 0 {
+		return
+	}
+	for _, task := range tasks {
+		localLink, transErr := TransToLocalLink(crawler.Config.MainSite, task.URL, task.URLType)
+		if transErr != nil {
+			continue
+		}
+		_, err = model.AssignLocalPath(crawler.DBClient, task.URL, localLink)
+		if err != nil {
+			return
+		}
+	}
+	logger.Infof("为%d条记录分配了本地链接", len(tasks))
+	return
+}
+
+// storageKeyOf 本地链接在存储中的路径, 即去掉起始的斜线.
+func storageKeyOf(localLink string) string {
+	return strings.TrimPrefix(localLink, "/")
+}
+
+// fixupLocalLinks 抓取结束后, 修正已存储的html与css文件中的链接.
+// 页面与css在解析时, 其引用的资源还没有被请求, 只能使用入队列时分配的本地链接;
+// 资源根据Content-Type追加了扩展名之后, 需要将这些文件中原来的链接替换为实际存储的链接.
+func (crawler *Crawler) fixupLocalLinks() (err error) {
+	mapping := map[string]string{}
+	documents := []string{}
+	crawler.DBClientMutex.Lock()
+	err = model.EachSuccessURLRecord(crawler.DBClient, func(task *model.URLRecord) {
+		if task.LocalPath == "" {
+			return
+		}
+		if task.OriginLocalPath != "" && task.OriginLocalPath != task.LocalPath {
+			mapping[task.OriginLocalPath] = task.LocalPath
+		}
+		ext := strings.ToLower(path.Ext(task.LocalPath))
+		if htmlURLPattern.MatchString(ext) || ext == ".css" {
+			documents = append(documents, task.LocalPath)
+		}
+	})
+	crawler.DBClientMutex.Unlock()
+	if err != nil || len(mapping) == 0 {
+		return
+	}
+
+	attrNames := crawler.linkAttrNames()
+	fixed := 0
+	for _, localLink := range documents {
+		key := storageKeyOf(localLink)
+		content, getErr := crawler.Storage.Get(key)
+		if getErr != nil {
+			logger.Errorf("读取本地文件失败: file: %s, error: %s", key, getErr.Error())
+			continue
+		}
+		content, changed, replaceErr := replaceLocalLinks(content, localLink, mapping, attrNames)
+		if replaceErr != nil {
+			logger.Errorf("修正本地链接失败: file: %s, error: %s", key, replaceErr.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		err = crawler.Storage.Put(key, content)
+		if err != nil {
+			logger.Errorf("写入文件失败: file: %s, error: %s", key, err.Error())
+			return
+		}
+		fixed++
+	}
+	logger.Infof("%d个本地链接根据实际类型追加了扩展名, 修正了%d个文件中的引用", len(mapping), fixed)
+	return
+}
+
+// linkAttrNames 页面解析时会改写为本地链接的属性, 包括配置的懒加载属性(style属性另外按css处理).
+func (crawler *Crawler) linkAttrNames() (attrNames map[string]bool) {
+	attrNames = map[string]bool{"href": true, "src": true, "srcset": true, "poster": true, "data": true, "action": true}
+	for _, attrName := range crawler.Config.LazyLoadAttrs {
+		attrNames[strings.ToLower(attrName)] = true
+	}
+	return
+}
+
+// replaceLocalLinks 将docLink对应的文档content中引用的旧本地链接替换为新的本地链接.
+// css文件按照css语法只替换其中的url; html页面解析为dom树, 只替换attrNames中的链接属性, style属性与style元素中的链接,
+// 正文, 脚本, 注释以及其他属性(如alt, title, value)中与链接相同的文字保持不变.
+// 相对路径的链接(RelativeLinks)相对于文档所在目录解析后再查找, 替换后仍然为相对路径. 链接后可以带有#锚点.
+func replaceLocalLinks(content []byte, docLink string, mapping map[string]string, attrNames map[string]bool) (output []byte, changed bool, err error) {
+	lookup := func(link string) (newLink string, exist bool) {
+		if strings.HasPrefix(link, "/") {
+			newLink, exist = mapping[link]
+			return
+		}
+		if link == "" || strings.Contains(link, "://") {
+			return
+		}
+		newLink, exist = mapping[path.Join(path.Dir(docLink), link)]
+		if exist {
+			newLink = relativeLocalLink(docLink, newLink)
+		}
+		return
+	}
+	replace := func(link string) (newLink string, ok bool) {
+		fragment := ""
+		if index := strings.Index(link, "#"); index >= 0 {
+			link, fragment = link[:index], link[index:]
+		}
+		newLink, ok = lookup(link)
+		if ok {
+			newLink += fragment
+			changed = true
+		}
+		return
+	}
+	if strings.ToLower(path.Ext(docLink)) == ".css" {
+		output = []byte(RewriteCSSURLs(string(content), replace))
+		return
+	}
+	output, err = replaceHTMLLocalLinks(content, attrNames, replace)
+	return
+}
+
+// replaceHTMLLocalLinks 解析已存储的html页面, 将attrNames中的链接属性, style属性与style元素中的链接交给replace处理,
+// 返回按照页面原来的编码重新生成的内容. replace没有替换任何链接时返回的内容没有意义.
+// 链接属性的值整体作为一个链接; srcset(包括data-srcset等懒加载属性)逐项替换; style属性与style元素按照css语法替换.
+func replaceHTMLLocalLinks(content []byte, attrNames map[string]bool, replace func(link string) (newLink string, ok bool)) (output []byte, err error) {
+	charsetName, err := getPageCharset(content)
+	if err != nil {
+		return
+	}
+	charset, exist := CharsetMap[strings.ToLower(charsetName)]
+	if !exist {
+		err = fmt.Errorf("未找到匹配的编码: %s", charsetName)
+		return
+	}
+	utf8Content, err := DecodeToUTF8(content, charset)
+	if err != nil {
+		return
+	}
+	htmlDom, err := goquery.NewDocumentFromReader(bytes.NewReader(utf8Content))
+	if err != nil {
+		return
+	}
+	htmlDom.Find("*").Each(func(i int, nodeItem *goquery.Selection) {
+		node := nodeItem.Nodes[0]
+		for j := range node.Attr {
+			attr := &node.Attr[j]
+			key := strings.ToLower(attr.Key)
+			switch {
+			case key == "style":
+				attr.Val = RewriteCSSURLs(attr.Val, replace)
+			case !attrNames[key]:
+				// 不是链接属性, 保持不变
+			case strings.HasSuffix(key, "srcset"):
+				candidates := ParseSrcset(attr.Val)
+				srcsetChanged := false
+				for _, candidate := range candidates {
+					if newLink, ok := replace(candidate.URL); ok {
+						candidate.URL = newLink
+						srcsetChanged = true
+					}
+				}
+				if srcsetChanged {
+					attr.Val = FormatSrcset(candidates)
+				}
+			default:
+				if newLink, ok := replace(attr.Val); ok {
+					attr.Val = newLink
+				}
+			}
+		}
+		if node.Data != "style" {
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.TextNode {
+				child.Data = RewriteCSSURLs(child.Data, replace)
+			}
+		}
+	})
+	htmlString, err := htmlDom.Html()
+	if err != nil {
+		return
+	}
+	htmlString = ReplaceHTMLCharacterEntities(htmlString, charset)
+	output, err = EncodeFromUTF8([]byte(htmlString), charset)
+	return
+}
@@ -0,0 +1,136 @@
+package crawler
+
+import "testing"
+
+func TestRelativeLocalLink(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		link string
+	}{
+		// 根目录下的文档
+		{"/index.html", "/about.html", "about.html"},
+		{"/index.html", "/static/css/main.css", "static/css/main.css"},
+		{"/index.html", "/cdn.example.com/x.js", "cdn.example.com/x.js"},
+		// 同一目录
+		{"/a/b/index.html", "/a/b/page.html", "page.html"},
+		{"/a/b/index.html", "/a/b/index.html", "index.html"},
+		// 每一级不同的目录对应一个../
+		{"/a/b/index.html", "/a/c.css", "../c.css"},
+		{"/a/b/index.html", "/index.html", "../../index.html"},
+		{"/a/b/c/d/page.html", "/a/x/y.png", "../../../x/y.png"},
+		{"/a/b/c/page.html", "/a/b/c/d/e.png", "d/e.png"},
+		// 目录名相同但不在同一级不算公共目录
+		{"/x/a/page.html", "/a/x/img.png", "../../a/x/img.png"},
+		// 文件名与目录名相同
+		{"/a/b.html", "/a/b.html/c.png", "b.html/c.png"},
+		{"/a/b/c.html", "/a/b", "../b"},
+		// 其他主机的资源存储在以主机名命名的目录中
+		{"/blog/post/1.html", "/cdn.example.com/lib/jquery.js", "../../cdn.example.com/lib/jquery.js"},
+		{"/cdn.example.com/css/a.css", "/cdn.example.com/fonts/a.woff", "../fonts/a.woff"},
+		{"/cdn.example.com/css/a.css", "/static/bg.png", "../../static/bg.png"},
+		// 第一段中含有冒号时以./起始, 否则会被当作协议
+		{"/wiki/index.html", "/wiki/File:a.png", "./File:a.png"},
+		{"/index.html", "/File:a.png", "./File:a.png"},
+		{"/wiki/a/index.html", "/wiki/File:a.png", "../File:a.png"},
+		{"/index.html", "/cdn.example.com:8080/x.js", "./cdn.example.com:8080/x.js"},
+	}
+	for _, test := range tests {
+		if link := relativeLocalLink(test.from, test.to); link != test.link {
+			t.Errorf("relativeLocalLink(%s, %s) = %s, 应为%s", test.from, test.to, link, test.link)
+		}
+	}
+}
+
+func TestReplaceLocalLinks(t *testing.T) {
+	mapping := map[string]string{
+		"/avatarwhid=5":      "/avatarwhid=5.png",
+		"/img/banner":        "/img/banner.jpg",
+		"/fonts/icon":        "/fonts/icon.woff2",
+		"/static/a b(1)":     "/static/a b(1).png",
+		"/cdn.example.com/x": "/cdn.example.com/x.js",
+	}
+	attrNames := (&Crawler{Config: NewConfig()}).linkAttrNames()
+	tests := []struct {
+		name    string
+		docLink string
+		content string
+		output  string
+		changed bool
+	}{
+		{
+			name:    "属性",
+			docLink: "/index.html",
+			content: `<html><head></head><body><img src="/avatarwhid=5" data-src="/img/banner"/><a href="/avatarwhid=5#top">a</a><script src="/cdn.example.com/x"></script></body></html>`,
+			output:  `<html><head></head><body><img src="/avatarwhid=5.png" data-src="/img/banner.jpg"/><a href="/avatarwhid=5.png#top">a</a><script src="/cdn.example.com/x.js"></script></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "正文, 脚本与注释保持不变",
+			docLink: "/index.html",
+			content: `<html><head><script>var a = "/avatarwhid=5"; load('/img/banner');</script></head><body><!-- "/img/banner" --><p>"/avatarwhid=5"</p><code>url(/img/banner)</code><textarea>'/img/banner'</textarea></body></html>`,
+			output:  `<html><head><script>var a = "/avatarwhid=5"; load('/img/banner');</script></head><body><!-- "/img/banner" --><p>"/avatarwhid=5"</p><code>url(/img/banner)</code><textarea>'/img/banner'</textarea></body></html>`,
+		},
+		{
+			name:    "只替换完整的链接",
+			docLink: "/index.html",
+			content: `<html><head></head><body><a href="/img/banner/2">a</a><a href="/img/banners">b</a><img alt="见/img/banner"/></body></html>`,
+			output:  `<html><head></head><body><a href="/img/banner/2">a</a><a href="/img/banners">b</a><img alt="见/img/banner"/></body></html>`,
+		},
+		{
+			name:    "只替换链接属性",
+			docLink: "/index.html",
+			content: `<html><head></head><body><input value="/img/banner"/><div data-url="/avatarwhid=5" title="/img/banner"></div><form action="/img/banner"></form></body></html>`,
+			output:  `<html><head></head><body><input value="/img/banner"/><div data-url="/avatarwhid=5" title="/img/banner"></div><form action="/img/banner.jpg"></form></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "srcset",
+			docLink: "/index.html",
+			content: `<html><head></head><body><img srcset="/img/banner 1x, /avatarwhid=5 2x, /other.png 3x"/><source data-srcset="/img/banner"/></body></html>`,
+			output:  `<html><head></head><body><img srcset="/img/banner.jpg 1x, /avatarwhid=5.png 2x, /other.png 3x"/><source data-srcset="/img/banner.jpg"/></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "style属性与style元素",
+			docLink: "/index.html",
+			content: `<html><head><style>/* url(/img/banner) */ .a { background: url("/img/banner"); } @font-face { src: url(/fonts/icon) format("woff2"); }</style></head><body><div style="background-image: url('/img/banner')">&#34;/img/banner&#34;</div></body></html>`,
+			output:  `<html><head><style>/* url(/img/banner) */ .a { background: url("/img/banner.jpg"); } @font-face { src: url(/fonts/icon.woff2) format("woff2"); }</style></head><body><div style="background-image: url(&#39;/img/banner.jpg&#39;)">&#34;/img/banner&#34;</div></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "属性中的&与引号",
+			docLink: "/index.html",
+			content: `<html><head></head><body><a href="/static/a b(1)" title="&#34;/img/banner&#34;">a&amp;b</a></body></html>`,
+			output:  `<html><head></head><body><a href="/static/a b(1).png" title="&#34;/img/banner&#34;">a&amp;b</a></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "相对链接",
+			docLink: "/blog/post/1.html",
+			content: `<html><head></head><body><img src="../../img/banner"/><img src="../../avatarwhid=5" srcset="../../img/banner 2x"/><a href="/img/banner">a</a></body></html>`,
+			output:  `<html><head></head><body><img src="../../img/banner.jpg"/><img src="../../avatarwhid=5.png" srcset="../../img/banner.jpg 2x"/><a href="/img/banner.jpg">a</a></body></html>`,
+			changed: true,
+		},
+		{
+			name:    "css文件",
+			docLink: "/static/css/main.css",
+			content: `/* url(/img/banner) */ .a { content: "/img/banner"; background: url(/img/banner), image-set("../../avatarwhid=5" 1x); } @import "/fonts/icon"; .b { background: url(/static/a\20 b\28 1\29) }`,
+			output:  `/* url(/img/banner) */ .a { content: "/img/banner"; background: url(/img/banner.jpg), image-set("../../avatarwhid=5.png" 1x); } @import "/fonts/icon.woff2"; .b { background: url(/static/a\ b\(1\).png) }`,
+			changed: true,
+		},
+	}
+	for _, test := range tests {
+		output, changed, err := replaceLocalLinks([]byte(test.content), test.docLink, mapping, attrNames)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if changed != test.changed {
+			t.Errorf("%s: changed = %t, 应为%t", test.name, changed, test.changed)
+		}
+		if changed && string(output) != test.output {
+			t.Errorf("%s:\n输出为: %s\n应为:   %s", test.name, output, test.output)
+		}
+	}
+}
@@ -2,25 +2,46 @@ package crawler
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/jinzhu/gorm"
 
 	"gitee.com/generals-space/site-mirror-go.git/model"
+	"gitee.com/generals-space/site-mirror-go.git/storage"
 	"gitee.com/generals-space/site-mirror-go.git/util"
+	"gitee.com/generals-space/site-mirror-go.git/warc"
 )
 
 var logger *util.Logger
 
 // Crawler ...
 type Crawler struct {
-	PageQueue  chan *model.URLRecord // 页面任务队列
-	AssetQueue chan *model.URLRecord // 静态资源任务队列
+	Frontier *Frontier       // 页面与静态资源的任务队列
+	Storage  storage.Storage // 抓取到的页面与静态资源的存储后端
+	// 未配置WARCPath时为nil
+	WARCWriter *warc.Writer
+	// 各站点的robots.txt缓存, 配置了IgnoreRobots时为nil
+	Robots *RobotsCache
+	// 按主机限制请求的并发数与频率
+	HostScheduler *HostScheduler
+	// 所有请求共享的http客户端
+	HTTPClient *http.Client
+	// HTTPClient使用的cookie jar, 抓取结束时保存到文件中
+	CookieJar *CookieJar
+	// update模式正常结束时的变化统计, 其他情况为nil
+	UpdateReport *UpdateReport
+	// 编译后的Config.HeaderRules
+	headerRules []*headerRule
+	// 正在解析的文档中引用的url, 解析完成后一次性写入数据库
+	references referenceBuffer
 
 	Config        *Config
 	DBClient      *gorm.DB
@@ -30,8 +51,11 @@ type Crawler struct {
 // NewCrawler 创建Crawler对象
 func NewCrawler(config *Config, _logger *util.Logger) (crawler *Crawler, err error) {
 	logger = _logger
-	pageQueue := make(chan *model.URLRecord, config.PageWorkerCount*config.LinkRatioInSinglePage)
-	assetQueue := make(chan *model.URLRecord, config.AssetWorkerCount*config.LinkRatioInSinglePage)
+	err = config.Validate()
+	if err != nil {
+		logger.Errorf("配置不合法: %s", err.Error())
+		return
+	}
 	urlObj, err := url.Parse(config.StartPage)
 	if err != nil {
 		logger.Errorf("解析起始地址失败: url: %s, %s", config.StartPage, err.Error())
@@ -40,20 +64,71 @@ func NewCrawler(config *Config, _logger *util.Logger) (crawler *Crawler, err err
 	mainSite := urlObj.Host // Host成员带端口.
 	config.MainSite = mainSite
 
+	httpClient, err := NewHTTPClient(config)
+	if err != nil {
+		logger.Errorf("初始化http客户端失败: %s", err.Error())
+		return
+	}
+	cookieJar, err := NewCookieJar(config.CookieJarPath())
+	if err != nil {
+		logger.Errorf("加载cookie失败: %s", err.Error())
+		return
+	}
+	if config.CookiesFile != "" {
+		var count int
+		count, err = cookieJar.ImportNetscapeCookies(config.CookiesFile)
+		if err != nil {
+			logger.Errorf("导入cookies.txt失败: file: %s, %s", config.CookiesFile, err.Error())
+			return
+		}
+		logger.Infof("从%s导入了%d条cookie", config.CookiesFile, count)
+	}
+	httpClient.Jar = cookieJar
 	dbClient, err := model.GetDB(config.SiteDBPath)
 	if err != nil {
 		logger.Errorf("初始化数据库失败: site db: %s, %s", config.SiteDBPath, err.Error())
 		return
 	}
+	store, err := NewStorage(config)
+	if err != nil {
+		logger.Errorf("初始化存储失败: storage: %s, %s", config.Storage, err.Error())
+		return
+	}
+	var warcWriter *warc.Writer
+	if config.WARCPath != "" {
+		warcWriter, err = warc.NewWriter(config.WARCPath, "site-mirror-go")
+		if err != nil {
+			logger.Errorf("打开WARC文件失败: warc: %s, %s", config.WARCPath, err.Error())
+			return
+		}
+	}
+	dbClientMutex := &sync.Mutex{}
 	crawler = &Crawler{
-		PageQueue:  pageQueue,
-		AssetQueue: assetQueue,
+		Frontier: NewFrontier(dbClient, dbClientMutex),
+		Storage:  store,
+
+		WARCWriter:    warcWriter,
+		HostScheduler: NewHostScheduler(config.DefaultHostLimit(), config.HostLimits),
+		HTTPClient:    httpClient,
+		CookieJar:     cookieJar,
+		headerRules:   compileHeaderRules(config.HeaderRules),
 
 		Config:        config,
 		DBClient:      dbClient,
-		DBClientMutex: &sync.Mutex{},
+		DBClientMutex: dbClientMutex,
+	}
+	if warcWriter != nil {
+		httpClient.CheckRedirect = crawler.recordRedirect
+	}
+	if !config.IgnoreRobots {
+		crawler.Robots = NewRobotsCache(crawler)
 	}
 
+	err = crawler.assignMissingLocalPaths()
+	if err != nil {
+		logger.Errorf("分配本地链接失败: %s", err.Error())
+		return
+	}
 	err = crawler.LoadTaskQueue()
 	if err != nil {
 		logger.Errorf("加载任务队列失败: %s", err.Error())
@@ -62,187 +137,463 @@ func NewCrawler(config *Config, _logger *util.Logger) (crawler *Crawler, err err
 	return
 }
 
-// Start 启动n个工作协程
-func (crawler *Crawler) Start() {
-	req := &model.URLRecord{
-		URL:         crawler.Config.StartPage,
-		URLType:     model.URLTypePage,
-		Refer:       "",
-		Depth:       1,
-		FailedTimes: 0,
+// EnqueueStartPages 将起始页面入队列.
+// 继续上一次未完成的抓取时不需要调用, 否则起始页面会被重新抓取.
+func (crawler *Crawler) EnqueueStartPages() {
+	startPages := append([]string{crawler.Config.StartPage}, crawler.Config.StartPages...)
+	for _, startPage := range startPages {
+		req := &model.URLRecord{
+			URL:         startPage,
+			URLType:     model.URLTypePage,
+			Refer:       "",
+			Depth:       1,
+			FailedTimes: 0,
+		}
+		crawler.EnqueuePage(req)
 	}
-	crawler.EnqueuePage(req)
+}
 
+// Run 启动n个工作协程, 并阻塞到抓取结束.
+// 当两个队列都为空且没有worker在处理任务时, 认为抓取已完成, worker全部退出, 返回nil;
+// ctx被取消时, worker处理完手头的任务后退出, 返回ctx.Err().
+// 从数据库中取出任务出错时worker同样会退出, 此时仍有未完成的任务, 返回错误而不是nil.
+// 返回前会关闭存储, WARC文件与数据库连接, 保证所有文件与记录都已写入.
+// 正常结束时会修正已存储的页面与css中, 指向被追加了扩展名的资源的链接.
+// 配置了LoginURL时, 先进行表单登录, 登录失败时不会开始抓取.
+func (crawler *Crawler) Run(ctx context.Context) (err error) {
+	defer func() {
+		err = crawler.close(err)
+	}()
+	if crawler.Config.LoginURL != "" {
+		err = crawler.Login(ctx)
+		if err != nil {
+			logger.Errorf("%s", err.Error())
+			return
+		}
+	}
+
+	workerGroup := &sync.WaitGroup{}
 	for i := 0; i < crawler.Config.PageWorkerCount; i++ {
-		go crawler.GetHTMLPage(i)
+		workerGroup.Add(1)
+		go func(num int) {
+			defer workerGroup.Done()
+			crawler.GetHTMLPage(ctx, num)
+		}(i)
 	}
 	for i := 0; i < crawler.Config.AssetWorkerCount; i++ {
-		go crawler.GetStaticAsset(i)
+		workerGroup.Add(1)
+		go func(num int) {
+			defer workerGroup.Done()
+			crawler.GetStaticAsset(ctx, num)
+		}(i)
 	}
+
+	// worker阻塞在Pop()中等待新任务, ctx被取消时需要主动唤醒.
+	stopWaking := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			logger.Info("抓取被取消, 等待worker退出")
+			crawler.Frontier.Wake()
+		case <-stopWaking:
+		}
+	}()
+
+	workerGroup.Wait()
+	close(stopWaking)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if frontierErr := crawler.Frontier.Err(); frontierErr != nil {
+		err = fmt.Errorf("读取任务队列失败: %s", frontierErr.Error())
+	} else if !crawler.Frontier.Finished() {
+		err = fmt.Errorf("worker已全部退出, 但仍有未完成的任务")
+	} else {
+		logger.Info("任务队列已空, 所有任务处理完成")
+		err = crawler.fixupLocalLinks()
+		if err != nil {
+			logger.Errorf("修正本地链接失败: %s", err.Error())
+			return
+		}
+		if crawler.Config.Update {
+			crawler.UpdateReport, err = crawler.finishUpdate()
+			if err != nil {
+				logger.Errorf("统计更新结果失败: %s", err.Error())
+			}
+		}
+	}
+	return
 }
 
-// getAndRead 发起请求获取页面或静态资源, 返回响应体内容.
-func (crawler *Crawler) getAndRead(req *model.URLRecord) (body []byte, header http.Header, err error) {
+// close 保存cookie, 关闭WARC文件, 存储与数据库连接, err为Run中已经出现的错误,
+// 关闭过程中的错误只在err为nil时返回.
+func (crawler *Crawler) close(err error) error {
+	saveErr := crawler.CookieJar.Save()
+	if saveErr != nil {
+		logger.Errorf("保存cookie失败: %s", saveErr.Error())
+		if err == nil {
+			err = saveErr
+		}
+	}
+
+	if crawler.WARCWriter != nil {
+		closeErr := crawler.WARCWriter.Close()
+		if closeErr != nil {
+			logger.Errorf("关闭WARC文件失败: %s", closeErr.Error())
+			if err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	closeErr := crawler.Storage.Close()
+	if closeErr != nil {
+		logger.Errorf("关闭存储失败: %s", closeErr.Error())
+		if err == nil {
+			err = closeErr
+		}
+	}
+
 	crawler.DBClientMutex.Lock()
-	err = model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusPending)
-	crawler.DBClientMutex.Unlock()
-	if err != nil {
-		logger.Infof("更新任务队列记录失败: req: %+v, error: %s", req, err.Error())
-		return
+	defer crawler.DBClientMutex.Unlock()
+	closeErr = crawler.DBClient.Close()
+	if closeErr != nil {
+		logger.Errorf("关闭数据库失败: %s", closeErr.Error())
+		if err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
 
+// getAndRead 发起请求获取页面或静态资源, 返回响应体内容.
+// 返回的body为nil时表示没有需要处理的内容(请求失败, 已安排重试或已放弃).
+// 网络错误, 5xx, 429与408按照指数退避重试, 其他非2xx响应直接标记为失败.
+// update模式中内容没有变化(304或内容哈希相同)时直接标记为成功, 同样返回nil.
+// ctx被取消时返回ctx.Err(), 任务状态保持为pending, 下次继续抓取时会重新加载.
+func (crawler *Crawler) getAndRead(ctx context.Context, req *model.URLRecord) (body []byte, header http.Header, err error) {
+	// 从Frontier中取出的任务已经是pending状态, 无需再更新.
 	if req.FailedTimes > crawler.Config.MaxRetryTimes {
 		logger.Infof("失败次数过多, 不再尝试: req: %+v", req)
+		crawler.markFailed(req)
 		return
 	}
 
 	if req.URLType == model.URLTypePage && 0 < crawler.Config.MaxDepth && crawler.Config.MaxDepth < req.Depth {
-		logger.Infof("当前页面已达到最大深度, 不再抓取: req: %+v", req)
+		// 标记为跳过, 否则任务一直是pending状态, 每次继续抓取时都会被重新加载
+		crawler.markSkipped(req, "当前页面已达到最大深度")
 		return
 	}
 
-	resp, err := getURL(req.URL, req.Refer, crawler.Config.UserAgent)
+	urlObj, err := url.Parse(req.URL)
 	if err != nil {
-		logger.Errorf("请求失败, 重新入队列: req: %+v, error: %s", req, err.Error())
-		req.FailedTimes++
-		if req.URLType == model.URLTypePage {
-			crawler.EnqueuePage(req)
-		} else {
-			crawler.EnqueueAsset(req)
+		logger.Errorf("解析地址失败: req: %+v, error: %s", req, err.Error())
+		crawler.markFailed(req)
+		err = nil
+		return
+	}
+	var crawlDelay time.Duration
+	if crawler.Robots != nil {
+		var allowed bool
+		allowed, crawlDelay, err = crawler.checkRobots(ctx, req, urlObj)
+		if err != nil || !allowed {
+			return
 		}
+	}
+	// 在读取完响应体之后才释放连接数
+	release, err := crawler.HostScheduler.Acquire(ctx, urlObj.Host, crawlDelay)
+	if err != nil {
+		logger.Infof("抓取被取消, 任务留待下次继续: req: %+v", req)
 		return
-	} else if resp.StatusCode == 404 {
-		// 抓取失败一般是5xx或403, 405等, 出现404基本上就没有重试的意义了, 可以直接放弃
-		crawler.DBClientMutex.Lock()
-		err = model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusFailed)
-		crawler.DBClientMutex.Unlock()
-		if err != nil {
-			logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+	}
+	defer release()
+
+	conditional := crawler.conditionalHeader(req)
+	requestCtx := ctx
+	if crawler.WARCWriter != nil {
+		// 重定向链中的每一跳由recordRedirect记录
+		requestCtx = context.WithValue(ctx, warcRecordKey{}, true)
+	}
+	resp, err := crawler.getURL(requestCtx, req.URL, req.Refer, crawler.userAgentFor(req.URL), conditional)
+	if err != nil {
+		if ctx.Err() != nil {
+			logger.Infof("抓取被取消, 任务留待下次继续: req: %+v", req)
+			err = ctx.Err()
+			return
 		}
+		crawler.retryLater(ctx, req, 0, err.Error())
+		err = nil
 		return
 	}
 	defer resp.Body.Close()
 
 	header = resp.Header
 	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		// 读取响应体时被取消, 或者连接中断, 不能把不完整的内容当作结果.
+		body = nil
+		if ctx.Err() != nil {
+			logger.Infof("抓取被取消, 任务留待下次继续: req: %+v", req)
+			err = ctx.Err()
+			return
+		}
+		crawler.retryLater(ctx, req, 0, "读取响应失败: "+err.Error())
+		err = nil
+		return
+	}
+	if crawler.WARCWriter != nil {
+		// WARC中保留所有的原始响应(解码之前), 包括404等错误响应.
+		warcErr := crawler.WARCWriter.WriteExchange(resp, body)
+		if warcErr != nil {
+			logger.Errorf("写入WARC记录失败: req: %+v, error: %s", req, warcErr.Error())
+		}
+	}
+	if resp.StatusCode == http.StatusNotModified && conditional != nil {
+		body = nil
+		crawler.markUnchanged(ctx, req, nil)
+		return
+	}
+	if isRetryableStatus(resp.StatusCode) {
+		body = nil
+		crawler.retryLater(ctx, req, parseRetryAfter(resp.Header, time.Now()), resp.Status)
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// 404, 403等重试也不会有不同的结果, 直接放弃
+		logger.Infof("响应状态码为%d, 放弃: req: %+v", resp.StatusCode, req)
+		body = nil
+		crawler.markFailed(req)
+		return
+	}
+	// 只有成功的响应才需要解码, 304, 503等响应的内容没有用处, 解码失败也不应影响对它们的处理.
+	body, err = decodeBody(resp.Header, body)
+	if err != nil {
+		logger.Errorf("解码响应失败, 放弃: req: %+v, error: %s", req, err.Error())
+		body = nil
+		err = nil
+		crawler.markFailed(req)
+		return
+	}
+	if info := fetchInfoOf(resp.Header, body); crawler.isUnchanged(req, info) {
+		body = nil
+		crawler.markUnchanged(ctx, req, info)
+		return
+	}
 
 	return
 }
 
+// checkRobots 检查robots.txt是否允许抓取, 同时返回其中的Crawl-delay.
+// 被规则禁止的任务直接标记为失败; robots.txt暂时无法获取时, 任务等到重新获取robots.txt之后再重试, 不计入失败次数.
+func (crawler *Crawler) checkRobots(ctx context.Context, req *model.URLRecord, urlObj *url.URL) (allowed bool, crawlDelay time.Duration, err error) {
+	rules := crawler.Robots.Rules(ctx, urlObj)
+	if ctx.Err() != nil {
+		logger.Infof("抓取被取消, 任务留待下次继续: req: %+v", req)
+		err = ctx.Err()
+		return
+	}
+	if !rules.retryAt.IsZero() {
+		crawler.postpone(req, rules.retryAt, "robots.txt暂时无法获取")
+		return
+	}
+	if !rules.Allowed(urlObj.RequestURI()) {
+		logger.Infof("robots.txt不允许抓取, 放弃: req: %+v", req)
+		crawler.markFailed(req)
+		return
+	}
+	allowed = true
+	crawlDelay = rules.CrawlDelay
+	return
+}
+
 // GetHTMLPage 工作协程, 从队列中获取任务, 请求html页面并解析
-func (crawler *Crawler) GetHTMLPage(num int) {
-	for req := range crawler.PageQueue {
+func (crawler *Crawler) GetHTMLPage(ctx context.Context, num int) {
+	for {
+		req := crawler.Frontier.Pop(ctx, model.URLTypePage)
+		if req == nil {
+			return
+		}
 		logger.Infof("取得页面任务: %+v", req)
+		crawler.getHTMLPage(ctx, req)
+		crawler.Frontier.Done(req)
+	}
+}
 
-		respBody, _, err := crawler.getAndRead(req)
+// getHTMLPage 请求html页面, 解析并改写其中的链接, 写入本地文件.
+// 链接指向的不是html时, 不解析直接写入.
+func (crawler *Crawler) getHTMLPage(ctx context.Context, req *model.URLRecord) {
+	respBody, respHeader, err := crawler.getAndRead(ctx, req)
+	if err != nil || respBody == nil {
+		return
+	}
+	fetchInfo := fetchInfoOf(respHeader, respBody)
 
-		// 编码处理
-		charsetName, err := getPageCharset(respBody)
-		if err != nil {
-			logger.Errorf("获取页面编码失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		charsetName = strings.ToLower(charsetName)
-		logger.Debugf("当前页面编码: %s, req: %+v", charsetName, req)
-		charset, exist := CharsetMap[charsetName]
-		if !exist {
-			logger.Debugf("未找到匹配的编码: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		utf8Coutent, err := DecodeToUTF8(respBody, charset)
-		if err != nil {
-			logger.Errorf("页面解码失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		utf8Reader := bytes.NewReader(utf8Coutent)
-		htmlDom, err := goquery.NewDocumentFromReader(utf8Reader)
+	// 页面链接也可能指向图片, 压缩包等其他类型的文件, 只有html才需要解析, 其他类型直接存储.
+	resource, mediaType := ClassifyResponse(respHeader, respBody, urlPathOf(req.URL))
+	if reason := resourceDisabled(resource, crawler.Config); reason != "" {
+		crawler.markSkipped(req, reason)
+		return
+	}
+	fileContent := respBody
+	if resource == ResourceHTML {
+		fileContent, err = crawler.parseHTMLPage(ctx, req, respBody)
 		if err != nil {
-			logger.Errorf("生成dom树失败: req: %+v, error: %s", req, err.Error())
-			continue
+			return
 		}
+	} else {
+		logger.Debugf("页面内容不是html, 不解析直接存储: req: %+v, type: %s", req, mediaType)
+	}
+	// 不是html的页面与没有扩展名的资源一样, 根据实际类型追加扩展名
+	fetchInfo.LocalPath, err = crawler.storedLocalLink(req, resource, mediaType)
+	if err != nil {
+		logger.Errorf("转换为本地链接失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	err = crawler.Storage.Put(storageKeyOf(fetchInfo.LocalPath), fileContent)
+	if err != nil {
+		logger.Errorf("写入文件失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
 
-		logger.Debugf("准备进行页面解析: req: %+v", req)
+	logger.Debugf("页面任务写入本地文件成功: req: %+v", req)
 
-		if 0 < crawler.Config.MaxDepth && crawler.Config.MaxDepth < req.Depth+1 {
-			logger.Infof("当前页面已达到最大深度, 不再解析新页面: %+v", req)
-		} else {
-			crawler.ParseLinkingPages(htmlDom, req)
-		}
-		crawler.ParseLinkingAssets(htmlDom, req)
+	err = crawler.markSuccess(req, fetchInfo)
+	if err != nil {
+		logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	logger.Debugf("页面任务完成: req: %+v", req)
+}
 
-		logger.Debugf("页面解析完成, 准备写入本地文件: req: %+v", req)
+// parseHTMLPage 解析html页面, 将其中的页面与资源链接入队列并改写为本地链接, 返回改写后的页面内容.
+// 出错或ctx被取消时返回err, 此时页面不应被存储.
+func (crawler *Crawler) parseHTMLPage(ctx context.Context, req *model.URLRecord, respBody []byte) (fileContent []byte, err error) {
+	// 编码处理
+	charsetName, err := getPageCharset(respBody)
+	if err != nil {
+		logger.Errorf("获取页面编码失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	charsetName = strings.ToLower(charsetName)
+	logger.Debugf("当前页面编码: %s, req: %+v", charsetName, req)
+	charset, exist := CharsetMap[charsetName]
+	if !exist {
+		err = fmt.Errorf("未找到匹配的编码: %s", charsetName)
+		logger.Debugf("未找到匹配的编码: req: %+v, charset: %s", req, charsetName)
+		return
+	}
+	utf8Coutent, err := DecodeToUTF8(respBody, charset)
+	if err != nil {
+		logger.Errorf("页面解码失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	utf8Reader := bytes.NewReader(utf8Coutent)
+	htmlDom, err := goquery.NewDocumentFromReader(utf8Reader)
+	if err != nil {
+		logger.Errorf("生成dom树失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
 
-		htmlString, err := htmlDom.Html()
-		if err != nil {
-			logger.Errorf("获取页面Html()值失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		htmlString = ReplaceHTMLCharacterEntities(htmlString, charset)
-		fileContent, err := EncodeFromUTF8([]byte(htmlString), charset)
-		if err != nil {
-			logger.Errorf("页面编码失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		fileDir, fileName, err := TransToLocalPath(crawler.Config.MainSite, req.URL, model.URLTypePage)
-		if err != nil {
-			logger.Errorf("转换为本地链接失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		err = WriteToLocalFile(crawler.Config.SitePath, fileDir, fileName, fileContent)
-		if err != nil {
-			logger.Errorf("写入文件失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
+	logger.Debugf("准备进行页面解析: req: %+v", req)
 
-		logger.Debugf("页面任务写入本地文件成功: req: %+v", req)
+	// 解析过程中收集页面引用的url, 解析完成后一次性写入数据库, 失败或被取消时丢弃.
+	defer crawler.discardReferences(req)
+	baseURL := ResolveBaseURL(htmlDom, req)
+	if 0 < crawler.Config.MaxDepth && crawler.Config.MaxDepth < req.Depth+1 {
+		logger.Infof("当前页面已达到最大深度, 不再解析新页面: %+v", req)
+	} else {
+		crawler.ParseLinkingPages(htmlDom, req, baseURL)
+	}
+	crawler.ParseLinkingAssets(htmlDom, req, baseURL)
+	crawler.ParseInlineStyles(htmlDom, req, baseURL)
+	// 解析过程中被取消时, 页面中的链接可能没有全部入库,
+	// 不能标记为成功, 保持pending状态等下次继续时重新抓取.
+	if ctx.Err() != nil {
+		logger.Infof("抓取被取消, 页面留待下次继续: req: %+v", req)
+		err = ctx.Err()
+		return
+	}
+	err = crawler.saveReferences(req)
+	if err != nil {
+		logger.Errorf("写入引用记录失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
 
-		crawler.DBClientMutex.Lock()
-		err = model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusSuccess)
-		crawler.DBClientMutex.Unlock()
-		if err != nil {
-			logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		logger.Debugf("页面任务完成: req: %+v", req)
+	logger.Debugf("页面解析完成, 准备写入本地文件: req: %+v", req)
+
+	htmlString, err := htmlDom.Html()
+	if err != nil {
+		logger.Errorf("获取页面Html()值失败: req: %+v, error: %s", req, err.Error())
+		return
 	}
+	htmlString = ReplaceHTMLCharacterEntities(htmlString, charset)
+	fileContent, err = EncodeFromUTF8([]byte(htmlString), charset)
+	if err != nil {
+		logger.Errorf("页面编码失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	return
 }
 
 // GetStaticAsset 工作协程, 从队列中获取任务, 获取静态资源并存储
-func (crawler *Crawler) GetStaticAsset(num int) {
-	for req := range crawler.AssetQueue {
+func (crawler *Crawler) GetStaticAsset(ctx context.Context, num int) {
+	for {
+		req := crawler.Frontier.Pop(ctx, model.URLTypeAsset)
+		if req == nil {
+			return
+		}
 		logger.Infof("取得静态资源任务: %+v", req)
+		crawler.getStaticAsset(ctx, req)
+		crawler.Frontier.Done(req)
+	}
+}
 
-		respBody, respHeader, err := crawler.getAndRead(req)
+// getStaticAsset 请求静态资源并写入本地文件, css文件需要解析并改写其中的链接
+func (crawler *Crawler) getStaticAsset(ctx context.Context, req *model.URLRecord) {
+	respBody, respHeader, err := crawler.getAndRead(ctx, req)
+	if err != nil || respBody == nil {
+		return
+	}
+	fetchInfo := fetchInfoOf(respHeader, respBody)
 
-		// 如果是css文件, 解析其中的链接, 否则直接存储.
-		field, exist := respHeader["Content-Type"]
-		if exist && field[0] == "text/css" {
-			respBody, err = crawler.parseCSSFile(respBody, req)
-			if err != nil {
-				logger.Errorf("解析css文件失败: req: %+v, error: %s", req, err.Error())
-				continue
-			}
+	// 根据响应的实际类型再次检查NoJs等开关, 如/img?id=3这样没有扩展名的图片.
+	resource, mediaType := ClassifyResponse(respHeader, respBody, urlPathOf(req.URL))
+	if reason := resourceDisabled(resource, crawler.Config); reason != "" {
+		crawler.markSkipped(req, reason)
+		return
+	}
+	// 如果是css文件, 解析其中的链接, 否则直接存储.
+	if resource == ResourceCSS {
+		// 解析过程中收集css文件引用的url, 解析完成后一次性写入数据库, 失败或被取消时丢弃.
+		defer crawler.discardReferences(req)
+		respBody = crawler.parseCSSFile(respBody, req)
+		if ctx.Err() != nil {
+			logger.Infof("抓取被取消, css文件留待下次继续: req: %+v", req)
+			return
 		}
-		fileDir, fileName, err := TransToLocalPath(crawler.Config.MainSite, req.URL, model.URLTypeAsset)
+		err = crawler.saveReferences(req)
 		if err != nil {
-			logger.Errorf("转换为本地链接失败: req: %+v, error: %s", req, err.Error())
-			continue
+			logger.Errorf("写入引用记录失败: req: %+v, error: %s", req, err.Error())
+			return
 		}
+	}
+	// 如/avatar?id=5这样没有扩展名的资源, 根据实际类型追加扩展名, 引用它的页面与css在抓取结束后统一修正.
+	fetchInfo.LocalPath, err = crawler.storedLocalLink(req, resource, mediaType)
+	if err != nil {
+		logger.Errorf("转换为本地链接失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
 
-		err = WriteToLocalFile(crawler.Config.SitePath, fileDir, fileName, respBody)
-		if err != nil {
-			logger.Errorf("写入文件失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		logger.Debugf("静态资源任务写入本地文件成功: req: %+v", req)
+	err = crawler.Storage.Put(storageKeyOf(fetchInfo.LocalPath), respBody)
+	if err != nil {
+		logger.Errorf("写入文件失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	logger.Debugf("静态资源任务写入本地文件成功: req: %+v", req)
 
-		crawler.DBClientMutex.Lock()
-		err = model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusSuccess)
-		crawler.DBClientMutex.Unlock()
-		if err != nil {
-			logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
-			continue
-		}
-		logger.Debugf("静态资源任务完成: req: %+v", req)
+	err = crawler.markSuccess(req, fetchInfo)
+	if err != nil {
+		logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+		return
 	}
+	logger.Debugf("静态资源任务完成: req: %+v", req)
 }
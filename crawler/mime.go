@@ -0,0 +1,120 @@
+package crawler
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// 资源类型, 用于NoJs, NoCSS, NoImages, NoFonts等开关, 以及判断是否需要解析.
+const (
+	ResourceHTML  = "html"
+	ResourceCSS   = "css"
+	ResourceJs    = "js"
+	ResourceImage = "image"
+	ResourceFont  = "font"
+	ResourceOther = "other"
+)
+
+// 媒体类型与资源类型的对应关系, 以image/与font/开头的类型另外判断
+var mediaTypeResources = map[string]string{
+	"text/html":                     ResourceHTML,
+	"application/xhtml+xml":         ResourceHTML,
+	"text/css":                      ResourceCSS,
+	"text/javascript":               ResourceJs,
+	"text/ecmascript":               ResourceJs,
+	"application/javascript":        ResourceJs,
+	"application/x-javascript":      ResourceJs,
+	"application/ecmascript":        ResourceJs,
+	"application/vnd.ms-fontobject": ResourceFont,
+	"application/font-woff":         ResourceFont,
+	"application/font-woff2":        ResourceFont,
+	"application/font-sfnt":         ResourceFont,
+	"application/x-font-ttf":        ResourceFont,
+	"application/x-font-otf":        ResourceFont,
+	"application/x-font-woff":       ResourceFont,
+	"application/x-font-opentype":   ResourceFont,
+	"application/x-font-truetype":   ResourceFont,
+}
+
+// 不能说明实际类型的媒体类型, 遇到时需要根据内容推测
+var genericMediaTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+	"text/plain":               true,
+}
+
+// resourceOfMediaType 根据不带参数的媒体类型判断资源类型
+func resourceOfMediaType(mediaType string) string {
+	if resource, exist := mediaTypeResources[mediaType]; exist {
+		return resource
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return ResourceImage
+	case strings.HasPrefix(mediaType, "font/"):
+		return ResourceFont
+	}
+	return ResourceOther
+}
+
+// ClassifyURL 响应到达之前, 根据url路径的扩展名(不包括查询参数)推测资源类型, 无法判断时返回ResourceOther.
+func ClassifyURL(urlPath string) string {
+	switch ext := strings.ToLower(path.Ext(urlPath)); {
+	case ext == ".js" || ext == ".mjs":
+		return ResourceJs
+	case ext == ".css":
+		return ResourceCSS
+	case imagePattern.MatchString(ext) || ext == ".svg" || ext == ".ico" || ext == ".avif":
+		return ResourceImage
+	case fontPattern.MatchString(ext):
+		return ResourceFont
+	case htmlURLPattern.MatchString(ext):
+		return ResourceHTML
+	}
+	return ResourceOther
+}
+
+// ClassifyResponse 根据响应判断资源类型, 返回资源类型与不带参数的媒体类型.
+// 优先使用Content-Type响应头(正确处理`text/css; charset=utf-8`这样带参数的值);
+// 响应头缺失或是octet-stream, text/plain等笼统的类型时, 根据内容推测(http.DetectContentType);
+// 仍然无法判断时, 根据url路径的扩展名推测, 一些服务器会将css, js以text/plain返回.
+func ClassifyResponse(header http.Header, body []byte, urlPath string) (resource string, mediaType string) {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	mediaType = strings.ToLower(mediaType)
+	if !genericMediaTypes[mediaType] {
+		resource = resourceOfMediaType(mediaType)
+		return
+	}
+
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(body))
+	if err == nil && !genericMediaTypes[sniffed] {
+		mediaType = sniffed
+		resource = resourceOfMediaType(mediaType)
+		return
+	}
+	// 内容推测也无法判断时(如以text/plain返回的css, js文件), 根据扩展名推测
+	resource = ClassifyURL(urlPath)
+	return
+}
+
+// resourceDisabled 判断该类型的资源是否被NoJs等开关排除, 返回排除的原因
+func resourceDisabled(resource string, config *Config) (reason string) {
+	switch {
+	case resource == ResourceJs && config.NoJs:
+		reason = "不抓取js资源"
+	case resource == ResourceCSS && config.NoCSS:
+		reason = "不抓取css资源"
+	case resource == ResourceImage && config.NoImages:
+		reason = "不抓取图片资源"
+	case resource == ResourceFont && config.NoFonts:
+		reason = "不抓取字体资源"
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package crawler
+
+import (
+	"net/http"
+	"testing"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+)
+
+var (
+	pngContent  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	gifContent  = []byte("GIF89a\x01\x00\x01\x00")
+	woffContent = []byte("wOFF\x00\x01\x00\x00")
+	htmlContent = []byte("<!DOCTYPE html><html><body>a</body></html>")
+)
+
+func TestClassifyURL(t *testing.T) {
+	tests := []struct {
+		urlPath  string
+		resource string
+	}{
+		{"/static/app.js", ResourceJs},
+		{"/static/app.MJS", ResourceJs},
+		{"/static/main.css", ResourceCSS},
+		{"/img/a.JPG", ResourceImage},
+		{"/img/icon.svg", ResourceImage},
+		{"/favicon.ico", ResourceImage},
+		{"/fonts/a.woff2", ResourceFont},
+		{"/index.html", ResourceHTML},
+		{"/feed.xml", ResourceHTML},
+		// 没有扩展名或者无法判断的扩展名
+		{"/avatar", ResourceOther},
+		{"/", ResourceOther},
+		{"/index.php", ResourceOther},
+		{"/files/a.pdf", ResourceOther},
+		// 只看最后一段的扩展名
+		{"/a.css/b", ResourceOther},
+	}
+	for _, test := range tests {
+		if resource := ClassifyURL(test.urlPath); resource != test.resource {
+			t.Errorf("ClassifyURL(%s) = %s, 应为%s", test.urlPath, resource, test.resource)
+		}
+	}
+}
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		urlPath     string
+		resource    string
+		mediaType   string
+	}{
+		{"带参数的Content-Type", "text/css; charset=utf-8", nil, "/a", ResourceCSS, "text/css"},
+		{"大写的Content-Type", "Text/HTML", nil, "/a", ResourceHTML, "text/html"},
+		{"xhtml", "application/xhtml+xml", nil, "/a", ResourceHTML, "application/xhtml+xml"},
+		{"js", "application/x-javascript", nil, "/a", ResourceJs, "application/x-javascript"},
+		{"svg", "image/svg+xml", nil, "/a", ResourceImage, "image/svg+xml"},
+		{"字体", "font/woff2", nil, "/a", ResourceFont, "font/woff2"},
+		{"旧的字体类型", "application/vnd.ms-fontobject", nil, "/a", ResourceFont, "application/vnd.ms-fontobject"},
+		{"其他类型", "application/pdf", nil, "/a.html", ResourceOther, "application/pdf"},
+		// 明确的Content-Type优先于扩展名与内容
+		{"Content-Type优先", "image/png", htmlContent, "/a.css", ResourceImage, "image/png"},
+		// 笼统的类型根据内容推测
+		{"没有Content-Type的图片", "", pngContent, "/avatar", ResourceImage, "image/png"},
+		{"octet-stream的图片", "application/octet-stream", gifContent, "/img?id=3", ResourceImage, "image/gif"},
+		{"octet-stream的字体", "binary/octet-stream", woffContent, "/font", ResourceFont, "font/woff"},
+		{"text/plain的html", "text/plain; charset=utf-8", htmlContent, "/page", ResourceHTML, "text/html"},
+		{"不合法的Content-Type", "text/html; charset", pngContent, "/a", ResourceImage, "image/png"},
+		// 内容推测也无法判断时根据扩展名
+		{"text/plain的css", "text/plain", []byte("body { color: red; }"), "/static/main.css", ResourceCSS, "text/plain"},
+		{"text/plain的js", "text/plain", []byte("alert(1)"), "/static/app.js", ResourceJs, "text/plain"},
+		{"没有扩展名的文本", "", []byte("hello"), "/readme", ResourceOther, ""},
+		{"没有扩展名的二进制内容", "application/octet-stream", []byte{0x00, 0x01, 0x02}, "/download", ResourceOther, "application/octet-stream"},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.contentType != "" {
+			header.Set("Content-Type", test.contentType)
+		}
+		resource, mediaType := ClassifyResponse(header, test.body, test.urlPath)
+		if resource != test.resource || mediaType != test.mediaType {
+			t.Errorf("%s: ClassifyResponse() = %s, %s, 应为%s, %s", test.name, resource, mediaType, test.resource, test.mediaType)
+		}
+	}
+}
+
+func TestResourceDisabled(t *testing.T) {
+	config := &Config{NoJs: true, NoImages: true}
+	tests := []struct {
+		resource string
+		disabled bool
+	}{
+		{ResourceJs, true},
+		{ResourceImage, true},
+		{ResourceCSS, false},
+		{ResourceFont, false},
+		{ResourceHTML, false},
+		{ResourceOther, false},
+	}
+	for _, test := range tests {
+		if reason := resourceDisabled(test.resource, config); (reason != "") != test.disabled {
+			t.Errorf("resourceDisabled(%s) = %q, 应为排除: %t", test.resource, reason, test.disabled)
+		}
+	}
+	all := &Config{NoJs: true, NoCSS: true, NoImages: true, NoFonts: true}
+	for _, resource := range []string{ResourceHTML, ResourceOther} {
+		if reason := resourceDisabled(resource, all); reason != "" {
+			t.Errorf("resourceDisabled(%s) = %q, 页面与其他资源不应被排除", resource, reason)
+		}
+	}
+}
+
+func TestWithMediaTypeExtension(t *testing.T) {
+	tests := []struct {
+		localLink string
+		mediaType string
+		output    string
+	}{
+		// 没有扩展名时追加
+		{"/avatarwhid=5", "image/png", "/avatarwhid=5.png"},
+		{"/img/banner", "image/jpeg", "/img/banner.jpg"},
+		{"/fonts/icon", "font/woff2", "/fonts/icon.woff2"},
+		{"/api/data", "application/json", "/api/data.json"},
+		{"/pic", "text/css", "/pic.css"},
+		// 扩展名相同, 或属于同一类资源时保持不变
+		{"/a.png", "image/png", "/a.png"},
+		{"/a.PNG", "image/png", "/a.PNG"},
+		{"/a.jpeg", "image/png", "/a.jpeg"},
+		{"/a.woff", "font/woff2", "/a.woff"},
+		{"/a.htm", "text/html", "/a.htm"},
+		// 其他类型的扩展名与媒体类型一致时保持不变
+		{"/doc.pdf", "application/pdf", "/doc.pdf"},
+		// 扩展名与类型不符时追加
+		{"/a.php", "image/gif", "/a.php.gif"},
+		{"/a.css", "image/png", "/a.css.png"},
+		// 笼统的类型与无法确定扩展名的类型保持不变
+		{"/download", "application/octet-stream", "/download"},
+		{"/readme", "text/plain", "/readme"},
+		{"/x", "application/x-unknown-type", "/x"},
+	}
+	for _, test := range tests {
+		if output := withMediaTypeExtension(test.localLink, test.mediaType); output != test.output {
+			t.Errorf("withMediaTypeExtension(%s, %s) = %s, 应为%s", test.localLink, test.mediaType, output, test.output)
+		}
+	}
+}
+
+// 存储时的本地链接: html页面保持不变, 页面链接指向的不是html时不再追加.html
+func TestStoredLocalLink(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		urlType   int
+		resource  string
+		mediaType string
+		localLink string
+	}{
+		{"html页面", "http://example.com/about", model.URLTypePage, ResourceHTML, "text/html", "/about.html"},
+		{"php页面", "http://example.com/index.php?id=1", model.URLTypePage, ResourceHTML, "text/html", "/index.phpwhid=1.html"},
+		{"页面链接指向图片", "http://example.com/pic", model.URLTypePage, ResourceImage, "image/png", "/pic.png"},
+		{"页面链接指向pdf", "http://example.com/report", model.URLTypePage, ResourceOther, "application/pdf", "/report.pdf"},
+		{"页面链接指向无法判断的类型", "http://example.com/download", model.URLTypePage, ResourceOther, "application/octet-stream", "/download"},
+		// url本身以.html结尾时, .html不是追加的
+		{"html扩展名的图片", "http://example.com/img.html", model.URLTypePage, ResourceImage, "image/gif", "/img.html.gif"},
+		{"没有扩展名的资源", "http://example.com/avatar?id=5", model.URLTypeAsset, ResourceImage, "image/png", "/avatarwhid=5.png"},
+		{"扩展名属于同一类资源", "http://example.com/a.jpeg", model.URLTypeAsset, ResourceImage, "image/png", "/a.jpeg"},
+		{"站外资源", "http://cdn.example.net/font?v=2", model.URLTypeAsset, ResourceFont, "font/woff", "/cdn.example.net/fontwhv=2.woff"},
+	}
+	crawler, cleanup := newTestCrawler(t, NewConfig())
+	defer cleanup()
+	for _, test := range tests {
+		req := &model.URLRecord{URL: test.url, URLType: test.urlType, Depth: 1}
+		crawler.enqueue(req, "测试")
+		localLink, err := crawler.storedLocalLink(req, test.resource, test.mediaType)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if localLink != test.localLink {
+			t.Errorf("%s: storedLocalLink(%s) = %s, 应为%s", test.name, test.url, localLink, test.localLink)
+		}
+		stored, err := crawler.LookupLocalLink(test.url, test.urlType)
+		if err != nil || stored != localLink {
+			t.Errorf("%s: 数据库中的本地链接为%s, %v, 应为%s", test.name, stored, err, localLink)
+		}
+	}
+}
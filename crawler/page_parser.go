@@ -1,20 +1,100 @@
 package crawler
 
 import (
+	"mime"
 	"strings"
 
 	"gitee.com/generals-space/site-mirror-go.git/model"
 	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
 )
 
-// ParseLinkingPages 解析并改写页面中的页面链接, 包括a, iframe等元素
-func (crawler *Crawler) ParseLinkingPages(htmlDom *goquery.Document, req *model.URLRecord) {
+// ResolveBaseURL 返回页面中相对链接的基准地址, 即第一个base[href]相对于页面url解析后的地址, 没有时为页面url.
+// 页面中的链接都会被改写为本地链接, base元素会使这些链接再次被错误地解析, 所以需要移除其href属性,
+// 没有其他属性(如target)时移除整个元素.
+func ResolveBaseURL(htmlDom *goquery.Document, req *model.URLRecord) (baseURL string) {
+	baseURL = req.URL
+	baseNode := htmlDom.Find("base[href]").First()
+	if baseNode.Length() == 0 {
+		return
+	}
+	href, _ := baseNode.Attr("href")
+	href = strings.TrimSpace(href)
+	if href != "" && !emptyLinkPattern.MatchString(href) {
+		fullURL, _ := joinURL(req.URL, href)
+		if strings.HasPrefix(fullURL, "http://") || strings.HasPrefix(fullURL, "https://") {
+			baseURL = fullURL
+		}
+	}
+	htmlDom.Find("base[href]").Each(func(i int, nodeItem *goquery.Selection) {
+		nodeItem.RemoveAttr("href")
+		if len(nodeItem.Nodes[0].Attr) == 0 {
+			nodeItem.Remove()
+		}
+	})
+	return
+}
+
+// ParseLinkingPages 解析并改写页面中的页面链接, 包括a, iframe等元素. 相对链接以baseURL为基准解析.
+// iframe, frame, area与GET表单的action都作为页面; object与embed嵌入的是html时作为页面, 其他作为静态资源.
+func (crawler *Crawler) ParseLinkingPages(htmlDom *goquery.Document, req *model.URLRecord, baseURL string) {
 	aList := htmlDom.Find("a")
-	crawler.parseLinkingPages(aList, req, "href")
+	crawler.parseLinkingPages(aList, req, baseURL, "href")
+
+	if !crawler.Config.NoIframes {
+		iframeList := htmlDom.Find("iframe")
+		crawler.parseLinkingPages(iframeList, req, baseURL, "src")
+	}
+	if !crawler.Config.NoFrames {
+		frameList := htmlDom.Find("frame")
+		crawler.parseLinkingPages(frameList, req, baseURL, "src")
+	}
+	if !crawler.Config.NoAreas {
+		areaList := htmlDom.Find("area")
+		crawler.parseLinkingPages(areaList, req, baseURL, "href")
+	}
+	if !crawler.Config.NoForms {
+		// POST表单提交的结果无法镜像, 只处理GET表单
+		formList := htmlDom.Find("form").FilterFunction(func(i int, nodeItem *goquery.Selection) bool {
+			method, _ := nodeItem.Attr("method")
+			method = strings.ToLower(strings.TrimSpace(method))
+			return method == "" || method == "get"
+		})
+		crawler.parseLinkingPages(formList, req, baseURL, "action")
+	}
+	if !crawler.Config.NoObjects {
+		objectList := htmlDom.Find("object").FilterFunction(func(i int, nodeItem *goquery.Selection) bool {
+			return embeddedURLType(nodeItem, "data") == model.URLTypePage
+		})
+		crawler.parseLinkingPages(objectList, req, baseURL, "data")
+	}
+	if !crawler.Config.NoEmbeds {
+		embedList := htmlDom.Find("embed").FilterFunction(func(i int, nodeItem *goquery.Selection) bool {
+			return embeddedURLType(nodeItem, "src") == model.URLTypePage
+		})
+		crawler.parseLinkingPages(embedList, req, baseURL, "src")
+	}
+}
+
+// embeddedURLType 判断object, embed元素嵌入的内容是页面还是静态资源.
+// 指定了type属性时以其为准, 否则根据链接的扩展名判断, 只有html作为页面, 其他(flash, pdf, 视频等)作为静态资源.
+func embeddedURLType(nodeItem *goquery.Selection, attrName string) int {
+	if mediaType, exist := nodeItem.Attr("type"); exist && strings.TrimSpace(mediaType) != "" {
+		mediaType, _, err := mime.ParseMediaType(mediaType)
+		if err == nil && resourceOfMediaType(strings.ToLower(mediaType)) == ResourceHTML {
+			return model.URLTypePage
+		}
+		return model.URLTypeAsset
+	}
+	link, _ := nodeItem.Attr(attrName)
+	if ClassifyURL(urlPathOf(strings.TrimSpace(link))) == ResourceHTML {
+		return model.URLTypePage
+	}
+	return model.URLTypeAsset
 }
 
 // parseLinkingPages 遍历选中节点, 解析链接入库, 同时修改节点的链接属性.
-func (crawler *Crawler) parseLinkingPages(nodeList *goquery.Selection, req *model.URLRecord, attrName string) {
+func (crawler *Crawler) parseLinkingPages(nodeList *goquery.Selection, req *model.URLRecord, baseURL string, attrName string) {
 	// nodeList.Nodes 对象表示当前选择器中包含的元素
 	nodeList.Each(func(i int, nodeItem *goquery.Selection) {
 		subURL, exist := nodeItem.Attr(attrName)
@@ -22,106 +102,187 @@ func (crawler *Crawler) parseLinkingPages(nodeList *goquery.Selection, req *mode
 			return
 		}
 
-		fullURL, fullURLWithoutFrag := joinURL(req.URL, subURL)
+		fullURL, fullURLWithoutFrag := joinURL(baseURL, subURL)
 		if !URLFilter(fullURL, model.URLTypePage, crawler.Config) {
+			if link, ok := rejectedLink(req, baseURL, fullURL); ok {
+				nodeItem.SetAttr(attrName, link)
+			}
 			return
 		}
-		localLink, err := TransToLocalLink(crawler.Config.MainSite, fullURL, model.URLTypePage)
-		if err != nil {
-			return
-		}
-		nodeItem.SetAttr(attrName, localLink)
-
-		// 新任务入队列
-		req := &model.URLRecord{
+		// 新任务入队列, 入库时分配本地链接
+		task := &model.URLRecord{
 			URL:     fullURLWithoutFrag,
 			URLType: model.URLTypePage,
 			Refer:   req.URL,
 			Depth:   req.Depth + 1,
 		}
-		crawler.EnqueuePage(req)
+		crawler.EnqueuePage(task)
+
+		localLink, err := crawler.linkFrom(req, fullURLWithoutFrag, model.URLTypePage)
+		if err != nil {
+			return
+		}
+		nodeItem.SetAttr(attrName, localLink)
 	})
 }
 
-// ParseLinkingAssets 解析并改写页面中的静态资源链接, 包括js, css, img等元素
-func (crawler *Crawler) ParseLinkingAssets(htmlDom *goquery.Document, req *model.URLRecord) {
+// ParseLinkingAssets 解析并改写页面中的静态资源链接, 包括js, css, img等元素. 相对链接以baseURL为基准解析.
+// 包括img与picture/video/audio中source的srcset, track字幕, video的poster封面, object与embed嵌入的媒体文件,
+// 以及配置的懒加载属性.
+func (crawler *Crawler) ParseLinkingAssets(htmlDom *goquery.Document, req *model.URLRecord, baseURL string) {
 	linkList := htmlDom.Find("link")
-	crawler.parseLinkingAssets(linkList, req, "href")
+	crawler.parseLinkingAssets(linkList, req, baseURL, "href")
 
 	scriptList := htmlDom.Find("script")
-	crawler.parseLinkingAssets(scriptList, req, "src")
+	crawler.parseLinkingAssets(scriptList, req, baseURL, "src")
 
 	imgList := htmlDom.Find("img")
-	crawler.parseLinkingAssets(imgList, req, "src")
+	crawler.parseLinkingAssets(imgList, req, baseURL, "src")
+	crawler.parseSrcsetAssets(imgList, req, baseURL, "srcset")
 
 	videoList := htmlDom.Find("video")
-	crawler.parseLinkingAssets(videoList, req, "src")
+	crawler.parseLinkingAssets(videoList, req, baseURL, "src")
+	crawler.parseLinkingAssets(videoList, req, baseURL, "poster")
 
 	audioList := htmlDom.Find("audio")
-	crawler.parseLinkingAssets(audioList, req, "src")
+	crawler.parseLinkingAssets(audioList, req, baseURL, "src")
+
+	sourceList := htmlDom.Find("source")
+	crawler.parseLinkingAssets(sourceList, req, baseURL, "src")
+	crawler.parseSrcsetAssets(sourceList, req, baseURL, "srcset")
+
+	trackList := htmlDom.Find("track")
+	crawler.parseLinkingAssets(trackList, req, baseURL, "src")
+
+	if !crawler.Config.NoObjects {
+		objectList := htmlDom.Find("object").FilterFunction(func(i int, nodeItem *goquery.Selection) bool {
+			return embeddedURLType(nodeItem, "data") == model.URLTypeAsset
+		})
+		crawler.parseLinkingAssets(objectList, req, baseURL, "data")
+	}
+	if !crawler.Config.NoEmbeds {
+		embedList := htmlDom.Find("embed").FilterFunction(func(i int, nodeItem *goquery.Selection) bool {
+			return embeddedURLType(nodeItem, "src") == model.URLTypeAsset
+		})
+		crawler.parseLinkingAssets(embedList, req, baseURL, "src")
+	}
+
+	for _, attrName := range crawler.Config.LazyLoadAttrs {
+		lazyList := htmlDom.Find("[" + attrName + "]")
+		if strings.HasSuffix(attrName, "srcset") {
+			crawler.parseSrcsetAssets(lazyList, req, baseURL, attrName)
+		} else {
+			crawler.parseLinkingAssets(lazyList, req, baseURL, attrName)
+		}
+	}
 }
 
-func (crawler *Crawler) parseLinkingAssets(nodeList *goquery.Selection, req *model.URLRecord, attrName string) {
+func (crawler *Crawler) parseLinkingAssets(nodeList *goquery.Selection, req *model.URLRecord, baseURL string, attrName string) {
 	// nodeList.Nodes 对象表示当前选择器中包含的元素
 	nodeList.Each(func(i int, nodeItem *goquery.Selection) {
 		subURL, exist := nodeItem.Attr(attrName)
-		if !exist || emptyLinkPattern.MatchString(subURL) {
+		if !exist {
 			return
 		}
+		localLink, ok := crawler.rewriteAssetLink(req, baseURL, subURL)
+		if ok {
+			nodeItem.SetAttr(attrName, localLink)
+		}
+	})
+}
 
-		fullURL, fullURLWithoutFrag := joinURL(req.URL, subURL)
-		if !URLFilter(fullURL, model.URLTypeAsset, crawler.Config) {
+// parseSrcsetAssets 解析srcset格式的属性, 其中的每个url分别入队列并改写, 描述符保持不变.
+func (crawler *Crawler) parseSrcsetAssets(nodeList *goquery.Selection, req *model.URLRecord, baseURL string, attrName string) {
+	nodeList.Each(func(i int, nodeItem *goquery.Selection) {
+		value, exist := nodeItem.Attr(attrName)
+		if !exist {
 			return
 		}
-		localLink, err := TransToLocalLink(crawler.Config.MainSite, fullURL, model.URLTypeAsset)
-		if err != nil {
-			return
+		candidates := ParseSrcset(value)
+		changed := false
+		for _, candidate := range candidates {
+			localLink, ok := crawler.rewriteAssetLink(req, baseURL, candidate.URL)
+			if ok {
+				candidate.URL = localLink
+				changed = true
+			}
 		}
-		nodeItem.SetAttr(attrName, localLink)
-
-		// 新任务入队列
-		req := &model.URLRecord{
-			URL:     fullURLWithoutFrag,
-			URLType: model.URLTypeAsset,
-			Refer:   req.URL,
-			Depth:   req.Depth + 1,
+		if changed {
+			nodeItem.SetAttr(attrName, FormatSrcset(candidates))
 		}
-		crawler.EnqueueAsset(req)
 	})
 }
 
+// rejectedLink 被过滤(黑名单, 站外等)而不抓取的链接. 页面中的base[href]已被移除,
+// 基准地址不是页面自身时需要改为绝对地址, 否则会相对于页面自身的位置解析; 其他情况下ok为false, 保留原链接.
+func rejectedLink(req *model.URLRecord, baseURL string, fullURL string) (link string, ok bool) {
+	if baseURL == req.URL {
+		return
+	}
+	link, ok = fullURL, true
+	return
+}
+
+// rewriteAssetLink 将页面中的静态资源链接入队列, 返回改写后的链接.
+// 链接为空, data:等无需处理的链接时ok为false, 此时应保留原链接; 被过滤的链接见rejectedLink.
+// 只有锚点的链接(如css中的filter: url(#blur))引用的是文档自身中的元素, 同样保留.
+func (crawler *Crawler) rewriteAssetLink(req *model.URLRecord, baseURL string, subURL string) (localLink string, ok bool) {
+	subURL = strings.TrimSpace(subURL)
+	if subURL == "" || strings.HasPrefix(subURL, "#") || emptyLinkPattern.MatchString(subURL) {
+		return
+	}
+	fullURL, fullURLWithoutFrag := joinURL(baseURL, subURL)
+	if !URLFilter(fullURL, model.URLTypeAsset, crawler.Config) {
+		localLink, ok = rejectedLink(req, baseURL, fullURL)
+		return
+	}
+	// 新任务入队列, 入库时分配本地链接
+	task := &model.URLRecord{
+		URL:     fullURLWithoutFrag,
+		URLType: model.URLTypeAsset,
+		Refer:   req.URL,
+		Depth:   req.Depth + 1,
+	}
+	crawler.EnqueueAsset(task)
+
+	localLink, err := crawler.linkFrom(req, fullURLWithoutFrag, model.URLTypeAsset)
+	if err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
 // parseCSSFile 解析css文件中的链接, 获取资源并修改其引用路径.
-// css中可能包含url属性,或者是background-image属性的引用路径,
-// 格式可能为url('./bg.jpg'), url("./bg.jpg"), url(bg.jpg)
-func (crawler *Crawler) parseCSSFile(content []byte, req *model.URLRecord) (newContent []byte, err error) {
-	fileStr := string(content)
-	// FindAllStringSubmatch返回值为切片, 是所有匹配到的字符串集合.
-	// 其成员也是切片, 此切片类似于FindStringSubmatch()的结果, 表示分组的匹配情况.
-	matchedArray := cssAssetURLPattern.FindAllStringSubmatch(fileStr, -1)
-	for _, matchedItem := range matchedArray {
-		for _, matchedURL := range matchedItem[1:] {
-			if matchedURL == "" || emptyLinkPattern.MatchString(matchedURL) {
-				continue
-			}
-			fullURL, fullURLWithoutFrag := joinURL(req.URL, matchedURL)
-			if !URLFilter(fullURL, model.URLTypeAsset, crawler.Config) {
-				return
-			}
-			localLink, err := TransToLocalLink(crawler.Config.MainSite, fullURL, model.URLTypeAsset)
-			if err != nil {
-				continue
-			}
-			fileStr = strings.Replace(fileStr, matchedURL, localLink, -1)
-			// 新任务入队列
-			req := &model.URLRecord{
-				URL:     fullURLWithoutFrag,
-				URLType: model.URLTypeAsset,
-				Refer:   req.URL,
-				Depth:   req.Depth + 1,
+// 包括url(), @import, image-set()以及@font-face的src列表, 详见RewriteCSSURLs.
+func (crawler *Crawler) parseCSSFile(content []byte, req *model.URLRecord) (newContent []byte) {
+	newContent = []byte(crawler.rewriteCSS(req, req.URL, string(content)))
+	return
+}
+
+// ParseInlineStyles 解析并改写页面中style元素与style属性中的css链接, 如横幅的背景图片. 相对链接以baseURL为基准解析.
+func (crawler *Crawler) ParseInlineStyles(htmlDom *goquery.Document, req *model.URLRecord, baseURL string) {
+	htmlDom.Find("style").Each(func(i int, nodeItem *goquery.Selection) {
+		// style元素的内容是原始文本, 不会被转义, 直接修改其中的文本节点
+		for child := nodeItem.Nodes[0].FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.TextNode {
+				child.Data = crawler.rewriteCSS(req, baseURL, child.Data)
 			}
-			crawler.EnqueueAsset(req)
 		}
-	}
-	newContent = []byte(fileStr)
-	return
+	})
+	htmlDom.Find("[style]").Each(func(i int, nodeItem *goquery.Selection) {
+		style, _ := nodeItem.Attr("style")
+		newStyle := crawler.rewriteCSS(req, baseURL, style)
+		if newStyle != style {
+			nodeItem.SetAttr("style", newStyle)
+		}
+	})
+}
+
+// rewriteCSS 解析css内容中的链接并入队列, 返回改写后的内容. 每个链接原地替换, 被过滤的链接保持不变.
+// css文件, style元素与style属性共用, req为css所在的文档(css文件或页面), 相对链接以baseURL为基准解析.
+func (crawler *Crawler) rewriteCSS(req *model.URLRecord, baseURL string, css string) string {
+	return RewriteCSSURLs(css, func(rawURL string) (newURL string, ok bool) {
+		return crawler.rewriteAssetLink(req, baseURL, rawURL)
+	})
 }
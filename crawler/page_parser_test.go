@@ -0,0 +1,321 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+	"gitee.com/generals-space/site-mirror-go.git/util"
+)
+
+// newTestCrawler 创建只包含配置, 数据库与任务队列的Crawler, 用于测试页面解析, 不会发出请求.
+func newTestCrawler(t *testing.T, config *Config) (crawler *Crawler, cleanup func()) {
+	logger = util.NewLogger(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "crawler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbClient, err := model.GetDB(filepath.Join(dir, "site.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if config.MainSite == "" {
+		config.MainSite = "example.com"
+	}
+	dbClientMutex := &sync.Mutex{}
+	crawler = &Crawler{
+		Frontier:      NewFrontier(dbClient, dbClientMutex),
+		Config:        config,
+		DBClient:      dbClient,
+		DBClientMutex: dbClientMutex,
+	}
+	cleanup = func() {
+		dbClient.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// parseTestPage 按照抓取时的顺序解析页面中的链接, 返回改写后的body内容
+func parseTestPage(t *testing.T, crawler *Crawler, pageURL string, content string) (body string) {
+	htmlDom, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &model.URLRecord{URL: pageURL, URLType: model.URLTypePage, Depth: 1}
+	baseURL := ResolveBaseURL(htmlDom, req)
+	crawler.ParseLinkingPages(htmlDom, req, baseURL)
+	crawler.ParseLinkingAssets(htmlDom, req, baseURL)
+	crawler.ParseInlineStyles(htmlDom, req, baseURL)
+	body, err = htmlDom.Find("body").Html()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// queuedURLs 返回已入队列的url与类型, 如["http://example.com/a.html:0"]
+func queuedURLs(t *testing.T, crawler *Crawler) (urls []string) {
+	records := []*model.URLRecord{}
+	err := crawler.DBClient.Order("id").Find(&records).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls = []string{}
+	for _, record := range records {
+		urls = append(urls, record.URL+":"+string('0'+rune(record.URLType)))
+	}
+	return
+}
+
+// 页面中有base[href]时base会被移除, 被过滤而不抓取的链接需要改为绝对地址, 否则会指向错误的位置
+func TestParseLinksWithBase(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   string
+		body   string
+		output string
+		queued []string
+	}{
+		{
+			name: "base在其他目录",
+			head: `<base href="/static/v2/">`,
+			body: `<a href="page.html">a</a><a href="private/x.html">b</a><a href="http://other.com/a.html">c</a>` +
+				`<a href="javascript:void(0)">d</a><img src="img/a.png"/><img src="private/b.png" srcset="img/a.png 1x, private/c.png 2x"/>`,
+			output: `<a href="/static/v2/page.html">a</a><a href="http://example.com/static/v2/private/x.html">b</a><a href="http://other.com/a.html">c</a>` +
+				`<a href="javascript:void(0)">d</a><img src="/static/v2/img/a.png"/><img src="http://example.com/static/v2/private/b.png" srcset="/static/v2/img/a.png 1x, http://example.com/static/v2/private/c.png 2x"/>`,
+			queued: []string{"http://example.com/static/v2/page.html:0", "http://example.com/static/v2/img/a.png:1"},
+		},
+		{
+			name:   "base在其他站点",
+			head:   `<base href="http://cdn.example.net/app/" target="_blank">`,
+			body:   `<a href="page.html">a</a><div style="background: url(private/bg.png)"></div>`,
+			output: `<a href="http://cdn.example.net/app/page.html">a</a><div style="background: url(http://cdn.example.net/app/private/bg.png)"></div>`,
+			queued: []string{},
+		},
+		{
+			name:   "没有base时被过滤的链接保持不变",
+			body:   `<a href="page.html">a</a><a href="private/x.html">b</a><img src="private/b.png"/>`,
+			output: `<a href="/blog/post/page.html">a</a><a href="private/x.html">b</a><img src="private/b.png"/>`,
+			queued: []string{"http://example.com/blog/post/page.html:0"},
+		},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		config.BlackList = []string{"/private/"}
+		config.OutsiteAsset = false
+		crawler, cleanup := newTestCrawler(t, config)
+		content := "<html><head>" + test.head + "</head><body>" + test.body + "</body></html>"
+		body := parseTestPage(t, crawler, "http://example.com/blog/post/1.html", content)
+		if body != test.output {
+			t.Errorf("%s:\n输出为: %s\n应为:   %s", test.name, body, test.output)
+		}
+		if urls := queuedURLs(t, crawler); strings.Join(urls, " ") != strings.Join(test.queued, " ") {
+			t.Errorf("%s: 入队列的url为%v, 应为%v", test.name, urls, test.queued)
+		}
+		cleanup()
+	}
+}
+
+// style元素与style属性中的链接与css文件一样入队列并改写
+func TestParseInlineStyles(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		output string
+		queued []string
+	}{
+		{
+			name:   "style元素",
+			body:   `<style>.a { background: url("../img/bg.png") } @import "/css/base.css"; /* url(no.png) */</style>`,
+			output: `<style>.a { background: url("/blog/img/bg.png") } @import "/css/base.css"; /* url(no.png) */</style>`,
+			queued: []string{"http://example.com/blog/img/bg.png:1", "http://example.com/css/base.css:1"},
+		},
+		{
+			name:   "style属性",
+			body:   `<div style="background-image: url(banner.jpg); color: red"></div><span style="color: red"></span>`,
+			output: `<div style="background-image: url(/blog/post/banner.jpg); color: red"></div><span style="color: red"></span>`,
+			queued: []string{"http://example.com/blog/post/banner.jpg:1"},
+		},
+		{
+			name:   "站外资源",
+			body:   `<div style="background: url('http://cdn.example.net/a.png?v=1')"></div>`,
+			output: `<div style="background: url(&#39;/cdn.example.net/a.pngwhv=1&#39;)"></div>`,
+			queued: []string{"http://cdn.example.net/a.png?v=1:1"},
+		},
+		{
+			name:   "被过滤的链接, data:与只有锚点的链接保持不变",
+			body:   `<style>.a { background: url(/private/a.png), url(data:image/png;base64,AAAA) }</style><i style="background: url(#icon)"></i>`,
+			output: `<style>.a { background: url(/private/a.png), url(data:image/png;base64,AAAA) }</style><i style="background: url(#icon)"></i>`,
+			queued: []string{},
+		},
+		{
+			name:   "同一资源只入队列一次",
+			body:   `<style>.a { background: url(/img/a.png) }</style><p style="background: url(http://example.com/img/a.png)"></p>`,
+			output: `<style>.a { background: url(/img/a.png) }</style><p style="background: url(/img/a.png)"></p>`,
+			queued: []string{"http://example.com/img/a.png:1"},
+		},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		config.BlackList = []string{"/private/"}
+		config.OutsiteAsset = true
+		crawler, cleanup := newTestCrawler(t, config)
+		content := "<html><head></head><body>" + test.body + "</body></html>"
+		body := parseTestPage(t, crawler, "http://example.com/blog/post/1.html", content)
+		if body != test.output {
+			t.Errorf("%s:\n输出为: %s\n应为:   %s", test.name, body, test.output)
+		}
+		if urls := queuedURLs(t, crawler); strings.Join(urls, " ") != strings.Join(test.queued, " ") {
+			t.Errorf("%s: 入队列的url为%v, 应为%v", test.name, urls, test.queued)
+		}
+		cleanup()
+	}
+}
+
+// iframe, frame, area, GET表单作为页面; object与embed根据type或扩展名区分页面与静态资源; 每种元素可以分别关闭
+func TestParseLinkingPagesElements(t *testing.T) {
+	body := `<a href="/a">a</a><iframe src="/frame/i.html"></iframe>` +
+		`<map><area href="/area" alt="x"/></map>` +
+		`<form action="/search"></form><form method="GET" action="/search2"></form><form method="post" action="/login"></form>` +
+		`<object data="/embed/page.html"></object><object data="/media/a.swf"></object><object data="/doc" type="text/html"></object>` +
+		`<embed src="/embed/e.htm"/><embed src="/media/v" type="video/mp4"/>`
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		output string
+		queued []string
+	}{
+		{
+			name:   "全部解析",
+			modify: func(config *Config) {},
+			output: `<a href="/a.html">a</a><iframe src="/frame/i.html"></iframe>` +
+				`<map><area href="/area.html" alt="x"/></map>` +
+				`<form action="/search.html"></form><form method="GET" action="/search2.html"></form><form method="post" action="/login"></form>` +
+				`<object data="/embed/page.html"></object><object data="/media/a.swf"></object><object data="/doc.html" type="text/html"></object>` +
+				`<embed src="/embed/e.htm"/><embed src="/media/v" type="video/mp4"/>`,
+			queued: []string{
+				"http://example.com/a:0", "http://example.com/frame/i.html:0",
+				"http://example.com/area:0", "http://example.com/search:0", "http://example.com/search2:0",
+				"http://example.com/embed/page.html:0", "http://example.com/doc:0", "http://example.com/embed/e.htm:0",
+				"http://example.com/media/a.swf:1", "http://example.com/media/v:1",
+			},
+		},
+		{
+			name: "关闭iframe, area与表单",
+			modify: func(config *Config) {
+				config.NoIframes = true
+				config.NoAreas = true
+				config.NoForms = true
+			},
+			output: `<a href="/a.html">a</a><iframe src="/frame/i.html"></iframe>` +
+				`<map><area href="/area" alt="x"/></map>` +
+				`<form action="/search"></form><form method="GET" action="/search2"></form><form method="post" action="/login"></form>` +
+				`<object data="/embed/page.html"></object><object data="/media/a.swf"></object><object data="/doc.html" type="text/html"></object>` +
+				`<embed src="/embed/e.htm"/><embed src="/media/v" type="video/mp4"/>`,
+			queued: []string{
+				"http://example.com/a:0",
+				"http://example.com/embed/page.html:0", "http://example.com/doc:0", "http://example.com/embed/e.htm:0",
+				"http://example.com/media/a.swf:1", "http://example.com/media/v:1",
+			},
+		},
+		{
+			name: "关闭embed",
+			modify: func(config *Config) {
+				config.NoEmbeds = true
+			},
+			output: `<a href="/a.html">a</a><iframe src="/frame/i.html"></iframe>` +
+				`<map><area href="/area.html" alt="x"/></map>` +
+				`<form action="/search.html"></form><form method="GET" action="/search2.html"></form><form method="post" action="/login"></form>` +
+				`<object data="/embed/page.html"></object><object data="/media/a.swf"></object><object data="/doc.html" type="text/html"></object>` +
+				`<embed src="/embed/e.htm"/><embed src="/media/v" type="video/mp4"/>`,
+			queued: []string{
+				"http://example.com/a:0", "http://example.com/frame/i.html:0",
+				"http://example.com/area:0", "http://example.com/search:0", "http://example.com/search2:0",
+				"http://example.com/embed/page.html:0", "http://example.com/doc:0",
+				"http://example.com/media/a.swf:1",
+			},
+		},
+		{
+			name: "关闭object",
+			modify: func(config *Config) {
+				config.NoObjects = true
+			},
+			output: `<a href="/a.html">a</a><iframe src="/frame/i.html"></iframe>` +
+				`<map><area href="/area.html" alt="x"/></map>` +
+				`<form action="/search.html"></form><form method="GET" action="/search2.html"></form><form method="post" action="/login"></form>` +
+				`<object data="/embed/page.html"></object><object data="/media/a.swf"></object><object data="/doc" type="text/html"></object>` +
+				`<embed src="/embed/e.htm"/><embed src="/media/v" type="video/mp4"/>`,
+			queued: []string{
+				"http://example.com/a:0", "http://example.com/frame/i.html:0",
+				"http://example.com/area:0", "http://example.com/search:0", "http://example.com/search2:0",
+				"http://example.com/embed/e.htm:0",
+				"http://example.com/media/v:1",
+			},
+		},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		test.modify(config)
+		crawler, cleanup := newTestCrawler(t, config)
+		content := "<html><head></head><body>" + body + "</body></html>"
+		output := parseTestPage(t, crawler, "http://example.com/blog/post/1.html", content)
+		if output != test.output {
+			t.Errorf("%s:\n输出为: %s\n应为:   %s", test.name, output, test.output)
+		}
+		if urls := queuedURLs(t, crawler); strings.Join(urls, " ") != strings.Join(test.queued, " ") {
+			t.Errorf("%s: 入队列的url为%v, 应为%v", test.name, urls, test.queued)
+		}
+		cleanup()
+	}
+}
+
+// frame只能出现在frameset中, 可以单独关闭
+func TestParseLinkingPagesFrames(t *testing.T) {
+	content := `<html><head></head><frameset cols="20%,80%"><frame src="menu.html"/><frame src="/main"/></frameset></html>`
+	tests := []struct {
+		noFrames bool
+		output   string
+		queued   []string
+	}{
+		{
+			noFrames: false,
+			output:   `<frameset cols="20%,80%"><frame src="/blog/post/menu.html"></frame><frame src="/main.html"></frame></frameset>`,
+			queued:   []string{"http://example.com/blog/post/menu.html:0", "http://example.com/main:0"},
+		},
+		{
+			noFrames: true,
+			output:   `<frameset cols="20%,80%"><frame src="menu.html"></frame><frame src="/main"></frame></frameset>`,
+			queued:   []string{},
+		},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		config.NoFrames = test.noFrames
+		crawler, cleanup := newTestCrawler(t, config)
+		htmlDom, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &model.URLRecord{URL: "http://example.com/blog/post/1.html", URLType: model.URLTypePage, Depth: 1}
+		crawler.ParseLinkingPages(htmlDom, req, ResolveBaseURL(htmlDom, req))
+		output, err := goquery.OuterHtml(htmlDom.Find("frameset"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != test.output {
+			t.Errorf("NoFrames=%t:\n输出为: %s\n应为:   %s", test.noFrames, output, test.output)
+		}
+		if urls := queuedURLs(t, crawler); strings.Join(urls, " ") != strings.Join(test.queued, " ") {
+			t.Errorf("NoFrames=%t: 入队列的url为%v, 应为%v", test.noFrames, urls, test.queued)
+		}
+		cleanup()
+	}
+}
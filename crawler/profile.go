@@ -0,0 +1,154 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ProfileEnvPrefix 环境变量覆盖配置时使用的前缀,
+// 如配置文件中的max_depth可以通过SITE_MIRROR_MAX_DEPTH覆盖.
+const ProfileEnvPrefix = "SITE_MIRROR_"
+
+// LoadProfile 从配置文件(profile)中读取配置, 覆盖config中的对应字段, 未出现的字段保持原值.
+// 文件格式由扩展名决定, 支持.json, .yaml(.yml), .toml,
+// 键名与Config中的json标签一致, 出现未知的键名时报错.
+func LoadProfile(filePath string, config *Config) (err error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		err = fmt.Errorf("读取配置文件失败: %s, %s", filePath, err.Error())
+		return
+	}
+
+	// yaml与toml先解析为通用的map结构, 再转换成json, 统一由json解码,
+	// 这样各格式只需要维护一套键名, 对未知键名的检查也是一致的.
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".json":
+	case ".yaml", ".yml":
+		var fields interface{}
+		err = yaml.Unmarshal(content, &fields)
+		if err != nil {
+			err = fmt.Errorf("解析yaml配置文件失败: %s, %s", filePath, err.Error())
+			return
+		}
+		content, err = json.Marshal(normalizeYAMLValue(fields))
+	case ".toml":
+		fields := map[string]interface{}{}
+		err = toml.Unmarshal(content, &fields)
+		if err != nil {
+			err = fmt.Errorf("解析toml配置文件失败: %s, %s", filePath, err.Error())
+			return
+		}
+		content, err = json.Marshal(fields)
+	default:
+		err = fmt.Errorf("不支持的配置文件格式: %s, 仅支持.json, .yaml, .yml, .toml", filePath)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("转换配置文件失败: %s, %s", filePath, err.Error())
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		err = fmt.Errorf("配置文件内容不合法: %s, %s", filePath, err.Error())
+		return
+	}
+	return
+}
+
+// normalizeYAMLValue yaml解析出的map键类型为interface{}, 无法直接转换为json, 这里递归转换为string.
+func normalizeYAMLValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, val := range v {
+			result[fmt.Sprint(key)] = normalizeYAMLValue(val)
+		}
+		return result
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeYAMLValue(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// LoadProfileEnv 用环境变量覆盖config中的对应字段.
+// 环境变量名为ProfileEnvPrefix加上json标签的大写形式, 列表类型的字段为json数组或以逗号分隔,
+// 其他复杂类型的字段需要以json格式给出.
+func LoadProfileEnv(config *Config) (err error) {
+	configValue := reflect.ValueOf(config).Elem()
+	configType := configValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		key := strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		envName := ProfileEnvPrefix + strings.ToUpper(key)
+		envValue, exist := os.LookupEnv(envName)
+		if !exist {
+			continue
+		}
+		err = setFieldFromString(configValue.Field(i), envValue)
+		if err != nil {
+			err = fmt.Errorf("环境变量不合法: %s=%s, %s", envName, envValue, err.Error())
+			return
+		}
+	}
+	return
+}
+
+func setFieldFromString(field reflect.Value, value string) (err error) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		var intValue int64
+		intValue, err = strconv.ParseInt(value, 10, 64)
+		field.SetInt(intValue)
+	case reflect.Float64:
+		var floatValue float64
+		floatValue, err = strconv.ParseFloat(value, 64)
+		field.SetFloat(floatValue)
+	case reflect.Bool:
+		var boolValue bool
+		boolValue, err = strconv.ParseBool(value)
+		field.SetBool(boolValue)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			err = json.Unmarshal([]byte(value), field.Addr().Interface())
+			return
+		}
+		// 正则等值中可能含有逗号(如\d{1,3}), 可以以json数组的形式给出; 不是json数组时以逗号分隔
+		list := []string{}
+		if strings.HasPrefix(strings.TrimSpace(value), "[") && json.Unmarshal([]byte(value), &list) == nil {
+			field.Set(reflect.ValueOf(list))
+			return
+		}
+		list = []string{}
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		err = json.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+	return
+}
@@ -0,0 +1,206 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+		check   func(config *Config) bool
+	}{
+		{
+			name:    "json",
+			file:    "site.json",
+			content: `{"max_depth": 2, "black_list": ["\\d{1,3}\\.html"], "headers": {"X-Token": "abc"}}`,
+			check: func(config *Config) bool {
+				return config.MaxDepth == 2 && reflect.DeepEqual(config.BlackList, []string{`\d{1,3}\.html`}) && config.Headers["X-Token"] == "abc"
+			},
+		},
+		{
+			name:    "yaml",
+			file:    "site.yml",
+			content: "page_worker_count: 3\nheader_rules:\n  - pattern: example\n    headers:\n      Referer: http://example.com/\n",
+			check: func(config *Config) bool {
+				return config.PageWorkerCount == 3 && len(config.HeaderRules) == 1 && config.HeaderRules[0].Headers["Referer"] == "http://example.com/"
+			},
+		},
+		{
+			name:    "toml",
+			file:    "site.toml",
+			content: "host_delay = 0.5\nno_js = true\n",
+			check: func(config *Config) bool {
+				return config.HostDelay == 0.5 && config.NoJs
+			},
+		},
+		{
+			name:    "未出现的字段保持原值",
+			file:    "keep.json",
+			content: `{}`,
+			check: func(config *Config) bool {
+				return config.UserAgent == DefaultUserAgent && config.PageWorkerCount == NewConfig().PageWorkerCount
+			},
+		},
+		{name: "json中未知的键名", file: "unknown.json", content: `{"max_depth": 2, "max_dpeth": 3}`, err: `unknown field "max_dpeth"`},
+		{name: "yaml中未知的键名", file: "unknown.yaml", content: "no_iframe: true\n", err: `unknown field "no_iframe"`},
+		{name: "toml中未知的键名", file: "unknown.toml", content: "workers = 2\n", err: `unknown field "workers"`},
+		{name: "类型不匹配", file: "type.json", content: `{"max_depth": "2"}`, err: "配置文件内容不合法"},
+		{name: "yaml格式错误", file: "bad.yaml", content: "max_depth: [1\n", err: "解析yaml配置文件失败"},
+		{name: "不支持的格式", file: "site.ini", content: "max_depth=2", err: "不支持的配置文件格式"},
+	}
+	for _, test := range tests {
+		filePath := filepath.Join(dir, test.file)
+		err = ioutil.WriteFile(filePath, []byte(test.content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := NewConfig()
+		err = LoadProfile(filePath, config)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: 错误为%v, 应包含%s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(config) {
+			t.Errorf("%s: 读取到的配置不正确: %+v", test.name, config)
+		}
+	}
+
+	err = LoadProfile(filepath.Join(dir, "none.json"), NewConfig())
+	if err == nil || !strings.Contains(err.Error(), "读取配置文件失败") {
+		t.Errorf("配置文件不存在时错误为%v", err)
+	}
+}
+
+func TestLoadProfileEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		err   string
+		check func(config *Config) bool
+	}{
+		{
+			name: "基本类型",
+			env: map[string]string{
+				"SITE_MIRROR_MAX_DEPTH":     "4",
+				"SITE_MIRROR_HOST_RPS":      "2.5",
+				"SITE_MIRROR_IGNORE_ROBOTS": "true",
+				"SITE_MIRROR_USER_AGENT":    "test-agent",
+			},
+			check: func(config *Config) bool {
+				return config.MaxDepth == 4 && config.HostRPS == 2.5 && config.IgnoreRobots && config.UserAgent == "test-agent"
+			},
+		},
+		{
+			name: "json数组中的元素可以含有逗号",
+			env:  map[string]string{"SITE_MIRROR_BLACK_LIST": `["\\d{1,3}\\.html", "/a,b/"]`},
+			check: func(config *Config) bool {
+				return reflect.DeepEqual(config.BlackList, []string{`\d{1,3}\.html`, "/a,b/"})
+			},
+		},
+		{
+			name: "以逗号分隔的列表",
+			env:  map[string]string{"SITE_MIRROR_LAZY_LOAD_ATTRS": "data-a, data-b,,"},
+			check: func(config *Config) bool {
+				return reflect.DeepEqual(config.LazyLoadAttrs, []string{"data-a", "data-b"})
+			},
+		},
+		{
+			name: "不是json数组时按逗号分隔",
+			env:  map[string]string{"SITE_MIRROR_START_PAGES": "[x, http://example.com/b"},
+			check: func(config *Config) bool {
+				return reflect.DeepEqual(config.StartPages, []string{"[x", "http://example.com/b"})
+			},
+		},
+		{
+			name: "复杂类型为json",
+			env: map[string]string{
+				"SITE_MIRROR_HEADERS":     `{"X-Token": "abc"}`,
+				"SITE_MIRROR_HOST_LIMITS": `[{"pattern": "cdn", "max_conns": 2}]`,
+			},
+			check: func(config *Config) bool {
+				return config.Headers["X-Token"] == "abc" && len(config.HostLimits) == 1 && config.HostLimits[0].Pattern == "cdn"
+			},
+		},
+		{name: "整数不合法", env: map[string]string{"SITE_MIRROR_MAX_DEPTH": "two"}, err: "SITE_MIRROR_MAX_DEPTH=two"},
+		{name: "json不合法", env: map[string]string{"SITE_MIRROR_HEADERS": "X-Token: abc"}, err: "SITE_MIRROR_HEADERS"},
+	}
+	for _, test := range tests {
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+		config := NewConfig()
+		err := LoadProfileEnv(config)
+		for name := range test.env {
+			os.Unsetenv(name)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: 错误为%v, 应包含%s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !test.check(config) {
+			t.Errorf("%s: 读取到的配置不正确: %+v", test.name, config)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		err    string
+	}{
+		{name: "默认配置", modify: func(config *Config) {}},
+		{name: "没有起始页面", modify: func(config *Config) { config.StartPage = "" }, err: "start_page"},
+		{name: "起始页面不是http地址", modify: func(config *Config) { config.StartPages = []string{"ftp://example.com/"} }, err: "start_page"},
+		{name: "页面工作协程数量为0", modify: func(config *Config) { config.PageWorkerCount = 0 }, err: "page_worker_count"},
+		{name: "静态资源工作协程数量为0", modify: func(config *Config) { config.AssetWorkerCount = 0 }, err: "asset_worker_count"},
+		{name: "抓取深度小于0", modify: func(config *Config) { config.MaxDepth = -1 }, err: "max_depth"},
+		{name: "黑名单正则不合法", modify: func(config *Config) { config.BlackList = []string{`\.css$`, `page(\d+`} }, err: "black_list[1]"},
+		{name: "请求头规则正则不合法", modify: func(config *Config) { config.HeaderRules = []*HeaderRule{{Pattern: "[a"}} }, err: "header_rules[0]"},
+		{name: "主机名正则不合法", modify: func(config *Config) { config.HostLimits = []*HostLimit{{Pattern: "*.cdn"}} }, err: "host_limits[0]"},
+		{name: "懒加载属性名不合法", modify: func(config *Config) { config.LazyLoadAttrs = []string{"data src"} }, err: "lazy_load_attrs[0]"},
+		{name: "不支持的存储类型", modify: func(config *Config) { config.Storage = "ftp" }, err: "storage"},
+		{name: "代理协议不支持", modify: func(config *Config) { config.Proxy = "ftp://127.0.0.1:21" }, err: "proxy"},
+	}
+	for _, test := range tests {
+		config := NewConfig()
+		config.StartPage = "http://example.com/"
+		test.modify(config)
+		err := config.Validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: 错误为%v, 应以%s起始", test.name, err, test.err)
+		}
+	}
+}
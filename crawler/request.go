@@ -2,10 +2,16 @@ package crawler
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"regexp"
 	"strings"
 
@@ -13,13 +19,26 @@ import (
 	"github.com/PuerkitoBio/goquery"
 )
 
-func getURL(url, refer, ua string) (resp *http.Response, err error) {
-	client := &http.Client{}
+// getURL 使用共享的http客户端发起GET请求, header为额外的请求头(如条件请求), 可以为nil.
+func (crawler *Crawler) getURL(ctx context.Context, url, refer, ua string, header http.Header) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		logger.Errorf("创建请求失败: url: %s, error: %s", url, err.Error())
+		return
+	}
+	// ctx被取消时, 正在进行的请求会立即中断.
+	req = req.WithContext(ctx)
 	req.Header.Set("User-Agent", ua)
 	req.Header.Set("Referer", refer)
+	// http客户端关闭了透明解压, 需要自行请求压缩, 调用者需要用decodeBody解码响应体.
+	req.Header.Set("Accept-Encoding", "gzip")
+	crawler.setAuthHeader(req)
+	crawler.setHeaders(req)
+	for key, values := range header {
+		req.Header[key] = values
+	}
 
-	resp, err = client.Do(req)
+	resp, err = crawler.HTTPClient.Do(req)
 	if err != nil {
 		logger.Errorf("请求失败: url: %s, refer: %s, error: %s", url, refer, err.Error())
 		return
@@ -27,6 +46,72 @@ func getURL(url, refer, ua string) (resp *http.Response, err error) {
 	return
 }
 
+// warcRecordKey 请求context中的标记, 只有抓取任务发出的请求(而不是robots.txt, 登录等)才会记录到WARC中
+type warcRecordKey struct{}
+
+// 与http.Client默认的重定向次数限制一致
+const maxRedirects = 10
+
+// recordRedirect 作为http客户端的CheckRedirect, 将重定向链中每一跳的3xx响应记录到WARC中.
+// req.Response为触发这次重定向的响应, 其响应体此时还未被读取.
+// 最终的响应由getAndRead记录.
+func (crawler *Crawler) recordRedirect(req *http.Request, via []*http.Request) (err error) {
+	if req.Context().Value(warcRecordKey{}) != nil && req.Response != nil {
+		resp := req.Response
+		body, readErr := ioutil.ReadAll(resp.Body)
+		if readErr != nil {
+			logger.Errorf("读取重定向响应失败: url: %s, error: %s", resp.Request.URL, readErr.Error())
+		} else {
+			warcErr := crawler.WARCWriter.WriteExchange(resp, body)
+			if warcErr != nil {
+				logger.Errorf("写入WARC记录失败: url: %s, error: %s", resp.Request.URL, warcErr.Error())
+			}
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if len(via) >= maxRedirects {
+		err = fmt.Errorf("重定向次数超过%d次", maxRedirects)
+	}
+	return
+}
+
+// decodeBody 按照Content-Encoding解码原始的响应体, 支持gzip与deflate, 未压缩时原样返回.
+func decodeBody(header http.Header, body []byte) (decoded []byte, err error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	var reader io.ReadCloser
+	switch encoding {
+	case "", "identity":
+		decoded = body
+		return
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+	case "deflate":
+		// deflate本应带有zlib头, 但有些服务端发送的是不带头的原始deflate数据
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		err = errors.New("不支持的Content-Encoding: " + encoding)
+		return
+	}
+	defer reader.Close()
+	decoded, err = ioutil.ReadAll(reader)
+	return
+}
+
+// urlPathOf 返回url的路径部分, 解析失败时返回空字符串
+func urlPathOf(fullURL string) string {
+	urlObj, err := url.Parse(fullURL)
+	if err != nil {
+		return ""
+	}
+	return urlObj.Path
+}
+
 func joinURL(baseURL, subURL string) (fullURL, fullURLWithoutFrag string) {
 	baseURLObj, _ := url.Parse(baseURL)
 	subURLObj, _ := url.Parse(subURL)
@@ -83,21 +168,12 @@ func URLFilter(fullURL string, urlType int, config *Config) (boolean bool) {
 		logger.Infof("不抓取站外资源: %s", fullURL)
 		return
 	}
-	if urlType == model.URLTypeAsset && strings.HasSuffix(fullURL, ".js") && config.NoJs == true {
-		logger.Infof("不抓取js资源: %s", fullURL)
-		return
-	}
-	if urlType == model.URLTypeAsset && strings.HasSuffix(fullURL, ".css") && config.NoCSS == true {
-		logger.Infof("不抓取css资源: %s", fullURL)
-		return
-	}
-	if urlType == model.URLTypeAsset && imagePattern.MatchString(fullURL) && config.NoImages == true {
-		logger.Infof("不抓取图片资源: %s", fullURL)
-		return
-	}
-	if urlType == model.URLTypeAsset && fontPattern.MatchString(fullURL) && config.NoFonts == true {
-		logger.Infof("不抓取字体资源: %s", fullURL)
-		return
+	// 这里只能根据扩展名判断, 没有扩展名的资源在响应到达后再根据实际类型判断.
+	if urlType == model.URLTypeAsset {
+		if reason := resourceDisabled(ClassifyURL(urlObj.Path), config); reason != "" {
+			logger.Infof("%s: %s", reason, fullURL)
+			return
+		}
 	}
 	for _, rule := range config.BlackList {
 		pattern := regexp.MustCompile(rule)
@@ -108,18 +184,3 @@ func URLFilter(fullURL string, urlType int, config *Config) (boolean bool) {
 	}
 	return true
 }
-
-// WriteToLocalFile ...
-func WriteToLocalFile(baseDir string, fileDir string, fileName string, fileContent []byte) (err error) {
-	fileDir = path.Join(baseDir, fileDir)
-	err = os.MkdirAll(fileDir, os.ModePerm)
-	filePath := path.Join(fileDir, fileName)
-	file, err := os.Create(filePath)
-	defer file.Close()
-
-	_, err = file.Write(fileContent)
-	if err != nil {
-		logger.Errorf("写入文件失败: %s", err.Error())
-	}
-	return
-}
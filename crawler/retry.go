@@ -0,0 +1,108 @@
+package crawler
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+)
+
+// isRetryableStatus 判断响应状态码是否值得重试.
+// 5xx, 429(请求过多)与408(请求超时)一般是暂时性的, 其他4xx重试也不会有不同的结果.
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout
+}
+
+// parseRetryAfter 解析Retry-After响应头, 支持秒数与http日期两种格式, 不存在或无法解析时返回0.
+func parseRetryAfter(header http.Header, now time.Time) (delay time.Duration) {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if value == "" {
+		return
+	}
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		if seconds > 0 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		return
+	}
+	at, err := http.ParseTime(value)
+	if err == nil && at.After(now) {
+		delay = at.Sub(now)
+	}
+	return
+}
+
+// retryDelay 计算第failedTimes次失败后的等待时间.
+// 指数退避: base * 2^(failedTimes-1), 不超过RetryMaxDelay, 再在[1/2, 1]倍之间随机,
+// 避免大量同时失败的任务在同一时刻重试. 服务端要求的Retry-After更长时以Retry-After为准.
+func retryDelay(config *Config, failedTimes int, retryAfter time.Duration) (delay time.Duration) {
+	base := time.Duration(config.RetryBaseDelay) * time.Second
+	maxDelay := time.Duration(config.RetryMaxDelay) * time.Second
+	delay = base
+	for i := 1; i < failedTimes && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	if delay < retryAfter {
+		delay = retryAfter
+	}
+	return
+}
+
+// retryLater 请求暂时失败, 增加失败次数后按退避时间重新入队列; 失败次数超过MaxRetryTimes时放弃.
+func (crawler *Crawler) retryLater(ctx context.Context, req *model.URLRecord, retryAfter time.Duration, reason string) {
+	req.FailedTimes++
+	if req.FailedTimes > crawler.Config.MaxRetryTimes {
+		logger.Errorf("失败次数过多, 不再尝试: req: %+v, error: %s", req, reason)
+		crawler.markFailed(req)
+		return
+	}
+	delay := retryDelay(crawler.Config, req.FailedTimes, retryAfter)
+	nextAttemptAt := time.Now().Add(delay).UTC()
+	req.NextAttemptAt = &nextAttemptAt
+	logger.Warnf("请求失败, %s后重试: req: %+v, error: %s", delay, req, reason)
+	crawler.requeue(req)
+}
+
+// postpone 任务暂时不能处理(如robots.txt暂时无法获取), 不计入失败次数, 到at时再重新入队列.
+func (crawler *Crawler) postpone(req *model.URLRecord, at time.Time, reason string) {
+	nextAttemptAt := at.UTC()
+	req.NextAttemptAt = &nextAttemptAt
+	logger.Warnf("%s, %s后重试: req: %+v", reason, time.Until(at).Round(time.Second), req)
+	crawler.requeue(req)
+}
+
+// markSkipped 响应的实际类型被NoJs等开关排除, 不存储
+func (crawler *Crawler) markSkipped(req *model.URLRecord, reason string) {
+	logger.Infof("%s, 不存储: req: %+v", reason, req)
+	crawler.DBClientMutex.Lock()
+	err := model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusSkipped)
+	crawler.DBClientMutex.Unlock()
+	if err != nil {
+		logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+	}
+}
+
+// markFailed 放弃任务, 标记为失败状态.
+// update模式中, 上一次抓取成功而本次失败的记录视为已删除.
+func (crawler *Crawler) markFailed(req *model.URLRecord) {
+	crawler.DBClientMutex.Lock()
+	err := model.UpdateURLRecordStatus(crawler.DBClient, req.URL, model.URLTaskStatusFailed)
+	if err == nil && crawler.Config.Update && req.UpdateState == model.UpdateStateUnvisited {
+		err = model.UpdateURLRecordUpdateState(crawler.DBClient, req.URL, model.UpdateStateRemoved)
+	}
+	crawler.DBClientMutex.Unlock()
+	if err != nil {
+		logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+	}
+}
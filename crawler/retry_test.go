@@ -0,0 +1,101 @@
+package crawler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		delay time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"1.5", 0},
+		{"soon", 0},
+		// http日期的三种格式
+		{"Wed, 21 Oct 2015 07:30:00 GMT", 2 * time.Minute},
+		{"Wednesday, 21-Oct-15 07:29:00 GMT", time.Minute},
+		{"Wed Oct 21 07:28:30 2015", 30 * time.Second},
+		// 已经过去的时间
+		{"Wed, 21 Oct 2015 07:00:00 GMT", 0},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.value != "" {
+			header.Set("Retry-After", test.value)
+		}
+		if delay := parseRetryAfter(header, now); delay != test.delay {
+			t.Errorf("parseRetryAfter(%q) = %s, 应为%s", test.value, delay, test.delay)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	config := &Config{RetryBaseDelay: 2, RetryMaxDelay: 60}
+	tests := []struct {
+		failedTimes int
+		retryAfter  time.Duration
+		// 随机之前的退避时间, 实际等待时间在[max/2, max]之间
+		max time.Duration
+	}{
+		{1, 0, 2 * time.Second},
+		{2, 0, 4 * time.Second},
+		{3, 0, 8 * time.Second},
+		{5, 0, 32 * time.Second},
+		// 不超过RetryMaxDelay
+		{6, 0, 60 * time.Second},
+		{20, 0, 60 * time.Second},
+		{1000, 0, 60 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := retryDelay(config, test.failedTimes, test.retryAfter)
+			if delay < test.max/2 || delay > test.max {
+				t.Errorf("retryDelay(%d) = %s, 应在[%s, %s]之间", test.failedTimes, delay, test.max/2, test.max)
+				break
+			}
+		}
+	}
+
+	// Retry-After更长时以其为准, 即使超过RetryMaxDelay
+	if delay := retryDelay(config, 1, 10*time.Minute); delay != 10*time.Minute {
+		t.Errorf("retryDelay(1, 10m) = %s, 应为10m", delay)
+	}
+	// Retry-After更短时仍按退避时间
+	if delay := retryDelay(config, 5, time.Second); delay < 16*time.Second {
+		t.Errorf("retryDelay(5, 1s) = %s, 应不少于16s", delay)
+	}
+	// 退避时间为0时立即重试
+	if delay := retryDelay(&Config{}, 3, 0); delay != 0 {
+		t.Errorf("RetryBaseDelay为0时retryDelay = %s, 应为0", delay)
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		retryable  bool
+	}{
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusRequestTimeout, true},
+		{http.StatusNotFound, false},
+		{http.StatusForbidden, false},
+		{http.StatusGone, false},
+		{http.StatusOK, false},
+	}
+	for _, test := range tests {
+		if retryable := isRetryableStatus(test.statusCode); retryable != test.retryable {
+			t.Errorf("isRetryableStatus(%d) = %t, 应为%t", test.statusCode, retryable, test.retryable)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// robots.txt最多读取的长度, RFC 9309要求至少支持500KiB
+const robotsMaxSize = 500 * 1024
+
+// robots.txt因服务端或网络错误无法获取时, 按照RFC 9309视为全部禁止, 但过一段时间后重新尝试获取.
+const robotsErrorTTL = time.Minute
+
+// robotsRule 一条Allow或Disallow规则
+type robotsRule struct {
+	allow   bool
+	path    string
+	pattern *regexp.Regexp
+}
+
+// RobotsRules 单个站点的robots.txt中适用于当前User-Agent的规则
+type RobotsRules struct {
+	rules []*robotsRule
+	// Crawl-delay, 两次请求之间的最小间隔
+	CrawlDelay time.Duration
+	// 为true时禁止抓取所有url, 用于robots.txt无法获取的情况
+	disallowAll bool
+	// robots.txt无法获取时重新获取的时间, 在此之前该站点的任务需要等待, 而不是放弃
+	retryAt time.Time
+}
+
+// Allowed 判断url路径(包含查询参数)是否允许抓取.
+// 匹配长度最长的规则生效, 长度相同时Allow优先, 没有匹配的规则时允许抓取.
+func (rules *RobotsRules) Allowed(requestURI string) bool {
+	if rules.disallowAll {
+		return false
+	}
+	var matched *robotsRule
+	for _, rule := range rules.rules {
+		if !rule.pattern.MatchString(requestURI) {
+			continue
+		}
+		if matched == nil || len(rule.path) > len(matched.path) ||
+			(len(rule.path) == len(matched.path) && rule.allow) {
+			matched = rule
+		}
+	}
+	return matched == nil || matched.allow
+}
+
+// ParseRobots 解析robots.txt, 返回适用于userAgent的规则.
+// 优先使用User-agent与userAgent匹配(不区分大小写的包含关系)且最长的分组, 没有时使用`*`分组.
+// 连续的多行User-agent共享同一组规则.
+func ParseRobots(content []byte, userAgent string) (rules *RobotsRules) {
+	userAgent = strings.ToLower(userAgent)
+	type group struct {
+		agents     []string
+		rules      []*robotsRule
+		crawlDelay time.Duration
+	}
+	groups := []*group{}
+	var current *group
+	lastIsAgent := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		if key == "user-agent" {
+			if !lastIsAgent {
+				current = &group{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastIsAgent = true
+			continue
+		}
+		lastIsAgent = false
+		if current == nil {
+			continue
+		}
+		switch key {
+		case "allow", "disallow":
+			// 空的Disallow表示不做限制
+			if value == "" {
+				continue
+			}
+			current.rules = append(current.rules, &robotsRule{
+				allow:   key == "allow",
+				path:    value,
+				pattern: robotsPattern(value),
+			})
+		case "crawl-delay":
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	var matched *group
+	matchedLen := -1
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			if agent == "*" {
+				if matchedLen < 0 {
+					matched, matchedLen = g, 0
+				}
+				continue
+			}
+			if strings.Contains(userAgent, agent) && len(agent) > matchedLen {
+				matched, matchedLen = g, len(agent)
+			}
+		}
+	}
+	rules = &RobotsRules{}
+	if matched != nil {
+		rules.rules = matched.rules
+		rules.CrawlDelay = matched.crawlDelay
+	}
+	return
+}
+
+// robotsPattern 将robots.txt中的路径规则转换为正则, 支持`*`通配符与表示结尾的`$`
+func robotsPattern(rulePath string) *regexp.Regexp {
+	anchored := strings.HasSuffix(rulePath, "$")
+	rulePath = strings.TrimSuffix(rulePath, "$")
+	patternStr := "^" + strings.Replace(regexp.QuoteMeta(rulePath), `\*`, ".*", -1)
+	if anchored {
+		patternStr += "$"
+	}
+	return regexp.MustCompile(patternStr)
+}
+
+// robotsEntry 单个站点的robots.txt缓存
+type robotsEntry struct {
+	ready    chan struct{}
+	rules    *RobotsRules
+	expireAt time.Time
+}
+
+// RobotsCache 按站点(scheme://host)缓存robots.txt, 其中的Crawl-delay由HostScheduler执行.
+type RobotsCache struct {
+	crawler *Crawler
+	mutex   *sync.Mutex
+	entries map[string]*robotsEntry
+}
+
+// NewRobotsCache ...
+func NewRobotsCache(crawler *Crawler) (cache *RobotsCache) {
+	cache = &RobotsCache{
+		crawler: crawler,
+		mutex:   &sync.Mutex{},
+		entries: map[string]*robotsEntry{},
+	}
+	return
+}
+
+// Rules 获取url所在站点的robots.txt规则, 第一次访问某个站点时会请求其robots.txt,
+// 同一站点的并发调用只会请求一次.
+func (cache *RobotsCache) Rules(ctx context.Context, urlObj *url.URL) (rules *RobotsRules) {
+	siteKey := urlObj.Scheme + "://" + urlObj.Host
+	cache.mutex.Lock()
+	entry, exist := cache.entries[siteKey]
+	if exist && !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		select {
+		case <-entry.ready:
+			exist = false
+		default:
+		}
+	}
+	if !exist {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		cache.entries[siteKey] = entry
+		cache.mutex.Unlock()
+
+		entryRules, expireAt := cache.fetch(ctx, siteKey)
+		cache.mutex.Lock()
+		entry.rules = entryRules
+		entry.expireAt = expireAt
+		cache.mutex.Unlock()
+		close(entry.ready)
+		return entryRules
+	}
+	cache.mutex.Unlock()
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+		return &RobotsRules{disallowAll: true}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return entry.rules
+}
+
+// fetch 请求并解析robots.txt.
+// 4xx表示站点没有robots.txt, 允许全部抓取; 5xx或网络错误时视为全部禁止, robotsErrorTTL之后重新获取.
+func (cache *RobotsCache) fetch(ctx context.Context, siteKey string) (rules *RobotsRules, expireAt time.Time) {
+	robotsURL := siteKey + "/robots.txt"
+	resp, err := cache.crawler.getURL(ctx, robotsURL, "", cache.crawler.Config.UserAgent, nil)
+	if err != nil {
+		logger.Warnf("获取robots.txt失败, 暂时禁止抓取该站点: url: %s, error: %s", robotsURL, err.Error())
+		expireAt = time.Now().Add(robotsErrorTTL)
+		rules = &RobotsRules{disallowAll: true, retryAt: expireAt}
+		return
+	}
+	defer resp.Body.Close()
+	if 400 <= resp.StatusCode && resp.StatusCode < 500 {
+		logger.Debugf("站点没有robots.txt, 允许全部抓取: url: %s, status: %d", robotsURL, resp.StatusCode)
+		rules = &RobotsRules{}
+		return
+	}
+	if resp.StatusCode >= 500 {
+		logger.Warnf("获取robots.txt失败, 暂时禁止抓取该站点: url: %s, status: %d", robotsURL, resp.StatusCode)
+		expireAt = time.Now().Add(robotsErrorTTL)
+		rules = &RobotsRules{disallowAll: true, retryAt: expireAt}
+		return
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, robotsMaxSize))
+	if err == nil {
+		content, err = decodeBody(resp.Header, content)
+	}
+	if err != nil {
+		logger.Warnf("读取robots.txt失败, 暂时禁止抓取该站点: url: %s, error: %s", robotsURL, err.Error())
+		expireAt = time.Now().Add(robotsErrorTTL)
+		rules = &RobotsRules{disallowAll: true, retryAt: expireAt}
+		return
+	}
+	rules = ParseRobots(content, cache.crawler.Config.UserAgent)
+	logger.Infof("已加载robots.txt: url: %s, 规则数量: %d, crawl-delay: %s", robotsURL, len(rules.rules), rules.CrawlDelay)
+	return
+}
@@ -0,0 +1,149 @@
+package crawler
+
+import (
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# 出现在User-agent之前的规则不属于任何分组
+Disallow: /everything
+
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Crawl-delay: 2
+
+User-agent: SiteMirror
+User-agent: othertool
+Disallow: /tmp
+Allow: /tmp/ok$
+DISALLOW: /*.pdf$   # 注释
+Disallow: /search*q=
+Allow: /page
+Disallow: /page
+Disallow: /a.b(c)
+Disallow:
+Crawl-delay: 0.5
+
+User-agent: SiteMirror/2.0
+Disallow: /v2-only
+`
+
+func TestRobotsRules(t *testing.T) {
+	tests := []struct {
+		userAgent  string
+		requestURI string
+		allowed    bool
+	}{
+		// 匹配User-agent的分组, 不再使用*分组
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/private/x", true},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/everything", true},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/tmp", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/tmp/x", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/tmpfile", false},
+		// 最长的规则生效, 与出现的顺序无关
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/tmp/ok", true},
+		// $表示结尾
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/tmp/ok/x", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/docs/a.pdf", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/docs/a.pdf?download=1", true},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/docs/a.pdfx", true},
+		// *匹配任意字符
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/search?q=go", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/search/all?lang=en&q=go", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/search?lang=en", true},
+		// 长度相同时Allow优先
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/page", true},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/page/2", true},
+		// 规则中的正则特殊字符按字面匹配
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/a.b(c)", false},
+		{"Mozilla/5.0 (compatible; SiteMirror/1.0)", "/axb(c)", true},
+		// 连续的User-agent共享同一组规则
+		{"othertool/3", "/tmp", false},
+		{"othertool/3", "/private/x", true},
+		// 多个分组都匹配时使用User-agent最长的分组
+		{"SiteMirror/2.0", "/v2-only", false},
+		{"SiteMirror/2.0", "/tmp", true},
+		// 没有匹配的分组时使用*分组
+		{"curl/8.0", "/private/x", false},
+		{"curl/8.0", "/private/", false},
+		{"curl/8.0", "/private", true},
+		{"curl/8.0", "/private/public", true},
+		{"curl/8.0", "/private/publicity", true},
+		{"curl/8.0", "/tmp", true},
+		{"curl/8.0", "/", true},
+	}
+	for _, test := range tests {
+		rules := ParseRobots([]byte(testRobots), test.userAgent)
+		if allowed := rules.Allowed(test.requestURI); allowed != test.allowed {
+			t.Errorf("user agent: %s, Allowed(%s) = %t, 应为%t", test.userAgent, test.requestURI, allowed, test.allowed)
+		}
+	}
+}
+
+func TestRobotsCrawlDelay(t *testing.T) {
+	tests := []struct {
+		userAgent  string
+		crawlDelay time.Duration
+	}{
+		{"SiteMirror/1.0", 500 * time.Millisecond},
+		{"curl/8.0", 2 * time.Second},
+		{"SiteMirror/2.0", 0},
+	}
+	for _, test := range tests {
+		rules := ParseRobots([]byte(testRobots), test.userAgent)
+		if rules.CrawlDelay != test.crawlDelay {
+			t.Errorf("user agent: %s, CrawlDelay = %s, 应为%s", test.userAgent, rules.CrawlDelay, test.crawlDelay)
+		}
+	}
+}
+
+func TestRobotsWithoutMatchingGroup(t *testing.T) {
+	tests := []string{
+		"",
+		"# 空文件\n",
+		"User-agent: otherbot\nDisallow: /\n",
+		"Disallow: /\n",
+	}
+	for _, content := range tests {
+		rules := ParseRobots([]byte(content), "SiteMirror/1.0")
+		if !rules.Allowed("/any/path?x=1") {
+			t.Errorf("没有适用的规则时应允许抓取: %q", content)
+		}
+	}
+
+	rules := &RobotsRules{disallowAll: true}
+	if rules.Allowed("/") {
+		t.Error("disallowAll时应禁止抓取")
+	}
+}
+
+func TestRobotsPattern(t *testing.T) {
+	tests := []struct {
+		rulePath   string
+		requestURI string
+		matched    bool
+	}{
+		{"/fish", "/fish", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish.asp", false},
+		{"/fish", "/catfish", false},
+		{"/fish*", "/fishheads/yummy.html", true},
+		{"/fish/", "/fish", false},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/folder/any.php.file.html", true},
+		{"/*.php$", "/filename.php", true},
+		{"/*.php$", "/filename.php?parameters", false},
+		{"/*.php$", "/filename.php/", false},
+		{"/fish*.php", "/fishheads/catfish.php?parameters", true},
+		{"/fish*.php", "/Fish.PHP", false},
+		{"/a?b", "/a?b=1", true},
+		{"/a+b", "/aab", false},
+	}
+	for _, test := range tests {
+		if matched := robotsPattern(test.rulePath).MatchString(test.requestURI); matched != test.matched {
+			t.Errorf("robotsPattern(%s).MatchString(%s) = %t, 应为%t", test.rulePath, test.requestURI, matched, test.matched)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+	"gitee.com/generals-space/site-mirror-go.git/storage"
+	"gitee.com/generals-space/site-mirror-go.git/util"
+)
+
+// 站外资源的域名目录, 端口中的冒号被转义为mh, 如/cdn.example.commh8080/a.js
+var hostDirPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*\.[a-zA-Z]{2,}(mh\d+)?$`)
+var hostPortPattern = regexp.MustCompile(`mh(\d+)$`)
+
+// Server 浏览镜像站点的静态服务器, 可以替代docker-compose.yml中的nginx.
+// 与nginx的try_files不同, 找不到的文件不会回退到首页, 而是返回"未镜像"页面, 并给出原始链接.
+// 文件通过Storage读取, 本地目录与s3等存储都可以直接浏览.
+type Server struct {
+	Storage storage.Storage
+	// 原站点的起始页面, 用于推算本地路径对应的原始链接
+	StartPage string
+
+	mainSite string
+	scheme   string
+	// 用于查询本地链接与原始url的对应关系, 每个请求单独查询, 没有数据库时为nil
+	dbClient *gorm.DB
+}
+
+// NewServer 创建静态服务器.
+// dbClient可以为nil, 此时"未镜像"页面中的原始链接只能根据本地路径推测.
+func NewServer(store storage.Storage, startPage string, dbClient *gorm.DB, _logger *util.Logger) (server *Server, err error) {
+	logger = _logger
+	server = &Server{
+		Storage:   store,
+		StartPage: startPage,
+	}
+	if startPage != "" {
+		var urlObj *url.URL
+		urlObj, err = url.Parse(startPage)
+		if err != nil {
+			return
+		}
+		server.mainSite = urlObj.Host
+		server.scheme = urlObj.Scheme
+	}
+	if dbClient != nil && server.mainSite != "" {
+		server.dbClient = dbClient
+	}
+	return
+}
+
+// recordOfURL 查询原始url对应的任务记录, 没有数据库或没有记录时返回nil.
+func (server *Server) recordOfURL(fullURL string) (record *model.URLRecord) {
+	if server.dbClient == nil {
+		return
+	}
+	record, err := model.QueryURLRecord(server.dbClient, fullURL)
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			logger.Errorf("查询任务记录失败: url: %s, error: %s", fullURL, err.Error())
+		}
+		record = nil
+		return
+	}
+	if record.LocalPath == "" {
+		// 旧版本的数据库, 抓取前还没有分配本地链接
+		record.LocalPath, err = TransToLocalLink(server.mainSite, record.URL, record.URLType)
+		if err != nil {
+			record = nil
+		}
+	}
+	return
+}
+
+// recordOfLocalLink 查询本地链接(包括入队列时分配的旧链接)对应的任务记录, 没有数据库或没有记录时返回nil.
+func (server *Server) recordOfLocalLink(localLink string) (record *model.URLRecord) {
+	if server.dbClient == nil {
+		return
+	}
+	record, err := model.QueryURLRecordByLocalPath(server.dbClient, localLink)
+	if err != nil {
+		if !gorm.IsRecordNotFoundError(err) {
+			logger.Errorf("查询任务记录失败: local path: %s, error: %s", localLink, err.Error())
+		}
+		record = nil
+	}
+	return
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, localLink := range server.candidates(r.URL) {
+		key := storageKeyOf(path.Clean("/" + localLink))
+		exist, err := server.Storage.Exists(key)
+		if err != nil {
+			logger.Errorf("查询文件失败: file: %s, error: %s", key, err.Error())
+			continue
+		}
+		if !exist {
+			continue
+		}
+		content, err := server.Storage.Get(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		server.serveContent(w, r, key, content)
+		return
+	}
+	// 与http.FileServer一致, 目录需要以斜线结尾, 以免页面中的相对链接出错
+	if r.URL.RawQuery == "" && !strings.HasSuffix(r.URL.Path, "/") {
+		exist, _ := server.Storage.Exists(storageKeyOf(path.Clean("/"+r.URL.Path) + "/index.html"))
+		if exist {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+	}
+	server.serveNotMirrored(w, r)
+}
+
+// candidates 请求路径可能对应的本地文件路径.
+// 页面中的链接已经被改写为本地路径, 一般直接就能找到; 但用户也可能直接访问原始路径(带有查询参数,
+// 或是.php等被追加了.html后缀的页面), 这时使用数据库中记录的本地链接,
+// 没有数据库或没有记录时按照TransToLocalLink的规则转换.
+func (server *Server) candidates(reqURL *url.URL) (localLinks []string) {
+	urlPath := reqURL.Path
+	if strings.HasSuffix(urlPath, "/") {
+		urlPath += "index.html"
+	}
+	if reqURL.RawQuery == "" {
+		localLinks = append(localLinks, urlPath)
+		// 入队列时分配的旧链接, 文件实际存储在追加了扩展名的路径下
+		if record := server.recordOfLocalLink(urlPath); record != nil && record.LocalPath != urlPath {
+			localLinks = append(localLinks, record.LocalPath)
+		}
+	}
+	if server.mainSite == "" {
+		return
+	}
+	fullURL := server.scheme + "://" + server.mainSite + reqURL.RequestURI()
+	if record := server.recordOfURL(fullURL); record != nil {
+		localLinks = append(localLinks, record.LocalPath)
+		return
+	}
+	for _, urlType := range []int{model.URLTypePage, model.URLTypeAsset} {
+		localLink, err := TransToLocalLink(server.mainSite, fullURL, urlType)
+		if err == nil {
+			localLinks = append(localLinks, localLink)
+		}
+	}
+	return
+}
+
+// serveContent 返回文件内容.
+// 带有查询参数的资源(如/avatar?id=5被存储为avatarwhid=5), 以及.php等动态页面的扩展名不能反映实际类型,
+// 需要去掉转义后的查询参数部分再判断, 仍然无法判断时根据文件内容推测.
+// 存储中没有记录文件的修改时间, 不返回Last-Modified.
+func (server *Server) serveContent(w http.ResponseWriter, r *http.Request, key string, content []byte) {
+	fileName := path.Base(key)
+	contentType := localFileContentType(fileName)
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, fileName, time.Time{}, bytes.NewReader(content))
+}
+
+// localFileContentType 根据本地文件名推测Content-Type, 无法判断时返回空字符串.
+func localFileContentType(fileName string) (contentType string) {
+	contentType = mime.TypeByExtension(path.Ext(fileName))
+	if contentType != "" {
+		return
+	}
+	// 查询参数中的问号被转义为wh, 依次尝试去掉每个wh之后的部分, 如app.jswhv=1 -> app.js
+	escapedMark := SpecialCharsMap["?"]
+	for i := strings.Index(fileName, escapedMark); i >= 0; {
+		contentType = mime.TypeByExtension(path.Ext(fileName[:i]))
+		if contentType != "" {
+			return
+		}
+		next := strings.Index(fileName[i+len(escapedMark):], escapedMark)
+		if next < 0 {
+			break
+		}
+		i += len(escapedMark) + next
+	}
+	return
+}
+
+// serveNotMirrored 返回"未镜像"页面, 给出原始链接以便用户直接访问原站点.
+func (server *Server) serveNotMirrored(w http.ResponseWriter, r *http.Request) {
+	originURL := ""
+	reason := "该页面没有被镜像到本地."
+	if record := server.recordOfLocalLink(r.URL.Path); record != nil {
+		originURL = record.URL
+		switch record.Status {
+		case model.URLTaskStatusFailed:
+			reason = "该页面抓取失败, 没有被镜像到本地."
+		case model.URLTaskStatusSkipped:
+			reason = "该资源的类型被配置为不抓取, 没有被镜像到本地."
+		case model.URLTaskStatusInit, model.URLTaskStatusPending:
+			reason = "该页面还未抓取完成."
+		}
+	} else if server.mainSite != "" {
+		originURL = server.guessOriginURL(r.URL)
+	}
+	logger.Debugf("请求的文件未镜像: path: %s, origin: %s", r.URL.RequestURI(), originURL)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>未镜像</title></head><body>\n")
+	fmt.Fprintf(w, "<h1>404 未镜像</h1>\n<p>%s</p>\n<p>本地路径: <code>%s</code></p>\n", reason, html.EscapeString(r.URL.RequestURI()))
+	if originURL != "" {
+		escapedURL := html.EscapeString(originURL)
+		fmt.Fprintf(w, "<p>原始链接: <a href=\"%s\" rel=\"noreferrer\">%s</a></p>\n", escapedURL, escapedURL)
+	}
+	fmt.Fprintf(w, "</body></html>\n")
+}
+
+// guessOriginURL 没有数据库记录时, 根据本地路径推测原始链接.
+// 本地路径的转换并不可逆(如查询参数中的特殊字符), 这里只还原域名目录, 端口与查询参数的问号.
+func (server *Server) guessOriginURL(reqURL *url.URL) (originURL string) {
+	if reqURL.RawQuery != "" {
+		// 直接访问的原始路径
+		return server.scheme + "://" + server.mainSite + reqURL.RequestURI()
+	}
+	host := server.mainSite
+	urlPath := reqURL.Path
+	segments := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	if len(segments) == 2 && hostDirPattern.MatchString(segments[0]) {
+		host = hostPortPattern.ReplaceAllString(segments[0], ":$1")
+		urlPath = "/" + segments[1]
+	}
+	dir, fileName := path.Split(urlPath)
+	query := ""
+	escapedMark := SpecialCharsMap["?"]
+	// 只有转义标记之后的部分像是查询参数(包含等号)时才还原
+	if i := strings.Index(fileName, escapedMark); i > 0 && strings.Contains(fileName[i:], "=") {
+		query = "?" + fileName[i+len(escapedMark):]
+		fileName = fileName[:i]
+	}
+	if fileName == "index.html" {
+		fileName = ""
+	}
+	originURL = server.scheme + "://" + host + dir + fileName + query
+	return
+}
@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"strings"
+)
+
+// SrcsetCandidate srcset属性中的一项, 如`a.png 2x`中URL为a.png, Descriptor为2x
+type SrcsetCandidate struct {
+	URL        string
+	Descriptor string
+}
+
+// isSrcsetSpace html规范中的空白字符
+func isSrcsetSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r' || char == '\f'
+}
+
+// ParseSrcset 按照html规范解析img, source元素的srcset属性.
+// url是连续的非空白字符, 其中可以包含逗号(如/img/w_100,h_100/a.png), url以逗号结尾时该项没有描述符;
+// 描述符(如1x, 100w)一直到括号之外的逗号为止.
+func ParseSrcset(value string) (candidates []*SrcsetCandidate) {
+	i := 0
+	for i < len(value) {
+		for i < len(value) && (isSrcsetSpace(value[i]) || value[i] == ',') {
+			i++
+		}
+		if i >= len(value) {
+			break
+		}
+		start := i
+		for i < len(value) && !isSrcsetSpace(value[i]) {
+			i++
+		}
+		candidate := &SrcsetCandidate{URL: value[start:i]}
+		candidates = append(candidates, candidate)
+		if strings.HasSuffix(candidate.URL, ",") {
+			candidate.URL = strings.TrimRight(candidate.URL, ",")
+			continue
+		}
+		start = i
+		depth := 0
+		for i < len(value) {
+			if value[i] == '(' {
+				depth++
+			} else if value[i] == ')' && depth > 0 {
+				depth--
+			} else if value[i] == ',' && depth == 0 {
+				break
+			}
+			i++
+		}
+		candidate.Descriptor = strings.Join(strings.Fields(value[start:i]), " ")
+		i++
+	}
+	return
+}
+
+// FormatSrcset 将各项重新拼接为srcset属性值
+func FormatSrcset(candidates []*SrcsetCandidate) string {
+	items := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Descriptor == "" {
+			items = append(items, candidate.URL)
+		} else {
+			items = append(items, candidate.URL+" "+candidate.Descriptor)
+		}
+	}
+	return strings.Join(items, ", ")
+}
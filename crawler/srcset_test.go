@@ -0,0 +1,109 @@
+package crawler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSrcset(t *testing.T) {
+	tests := []struct {
+		value      string
+		candidates []*SrcsetCandidate
+		formatted  string
+	}{
+		{"", nil, ""},
+		{" , ,", nil, ""},
+		{"a.png", []*SrcsetCandidate{{"a.png", ""}}, "a.png"},
+		{
+			"a.png 1x, b.png 2x",
+			[]*SrcsetCandidate{{"a.png", "1x"}, {"b.png", "2x"}},
+			"a.png 1x, b.png 2x",
+		},
+		// 逗号之后可以没有空白
+		{
+			"a.png 100w,b.png 200w",
+			[]*SrcsetCandidate{{"a.png", "100w"}, {"b.png", "200w"}},
+			"a.png 100w, b.png 200w",
+		},
+		// url中可以包含逗号
+		{
+			"/img/w_100,h_100/a.png 1x, /img/w_200,h_200/a.png 2x",
+			[]*SrcsetCandidate{{"/img/w_100,h_100/a.png", "1x"}, {"/img/w_200,h_200/a.png", "2x"}},
+			"/img/w_100,h_100/a.png 1x, /img/w_200,h_200/a.png 2x",
+		},
+		{
+			"data:image/png;base64,iVBORw0KGgo= 1x, b.png 2x",
+			[]*SrcsetCandidate{{"data:image/png;base64,iVBORw0KGgo=", "1x"}, {"b.png", "2x"}},
+			"data:image/png;base64,iVBORw0KGgo= 1x, b.png 2x",
+		},
+		// 中间没有空白时逗号属于url
+		{"a.png,b.png", []*SrcsetCandidate{{"a.png,b.png", ""}}, "a.png,b.png"},
+		// url以逗号结尾时该项没有描述符
+		{
+			"a.png, b.png 2x",
+			[]*SrcsetCandidate{{"a.png", ""}, {"b.png", "2x"}},
+			"a.png, b.png 2x",
+		},
+		{
+			"a.png,, b.png,",
+			[]*SrcsetCandidate{{"a.png", ""}, {"b.png", ""}},
+			"a.png, b.png",
+		},
+		// 换行等空白
+		{
+			"\n\t a.png\t1x,\n\t b.png  2x\n",
+			[]*SrcsetCandidate{{"a.png", "1x"}, {"b.png", "2x"}},
+			"a.png 1x, b.png 2x",
+		},
+		// 描述符中的多个空白合并为一个, 括号中的逗号不分隔候选项
+		{
+			"a.png  100w   2x , b.png foo(1, 2), c.png 3x",
+			[]*SrcsetCandidate{{"a.png", "100w 2x"}, {"b.png", "foo(1, 2)"}, {"c.png", "3x"}},
+			"a.png 100w 2x, b.png foo(1, 2), c.png 3x",
+		},
+		{
+			"a.png 1.5x, b.png 480h",
+			[]*SrcsetCandidate{{"a.png", "1.5x"}, {"b.png", "480h"}},
+			"a.png 1.5x, b.png 480h",
+		},
+	}
+	for _, test := range tests {
+		candidates := ParseSrcset(test.value)
+		if !reflect.DeepEqual(candidates, test.candidates) {
+			t.Errorf("ParseSrcset(%q) = %s, 应为%s", test.value, formatCandidates(candidates), formatCandidates(test.candidates))
+			continue
+		}
+		if formatted := FormatSrcset(candidates); formatted != test.formatted {
+			t.Errorf("FormatSrcset(ParseSrcset(%q)) = %q, 应为%q", test.value, formatted, test.formatted)
+		}
+	}
+}
+
+// formatCandidates 便于输出的各项内容, 如[a.png|1x b.png|]
+func formatCandidates(candidates []*SrcsetCandidate) string {
+	output := "["
+	for i, candidate := range candidates {
+		if i > 0 {
+			output += " "
+		}
+		output += candidate.URL + "|" + candidate.Descriptor
+	}
+	return output + "]"
+}
+
+// 修改url后重新拼接, 描述符保持不变
+func TestFormatSrcsetAfterRewrite(t *testing.T) {
+	mapping := map[string]string{
+		"/img/w_100,h_100/a.png":              "/img/w_100,h_100/a.png.webp",
+		"https://cdn.example.com/b.png?s=1,2": "/cdn.example.com/b.pngwhs=1,2.png",
+		"c.png":                               "../c.png",
+	}
+	candidates := ParseSrcset("/img/w_100,h_100/a.png 1x, https://cdn.example.com/b.png?s=1,2 2x, c.png")
+	for _, candidate := range candidates {
+		candidate.URL = mapping[candidate.URL]
+	}
+	want := "/img/w_100,h_100/a.png.webp 1x, /cdn.example.com/b.pngwhs=1,2.png 2x, ../c.png"
+	if formatted := FormatSrcset(candidates); formatted != want {
+		t.Errorf("FormatSrcset() = %q, 应为%q", formatted, want)
+	}
+}
@@ -0,0 +1,38 @@
+package crawler
+
+import (
+	"fmt"
+
+	"gitee.com/generals-space/site-mirror-go.git/storage"
+)
+
+// 存储类型, 对应Config.Storage
+const (
+	StorageLocal  = "local"
+	StorageMemory = "memory"
+	StorageZip    = "zip"
+	StorageTar    = "tar"
+	StorageS3     = "s3"
+)
+
+// NewStorage 根据配置创建存储后端
+func NewStorage(config *Config) (store storage.Storage, err error) {
+	switch config.Storage {
+	case StorageLocal, "":
+		store = storage.NewLocalStorage(config.SitePath)
+	case StorageMemory:
+		store = storage.NewMemoryStorage()
+	case StorageZip:
+		store, err = storage.NewArchiveStorage(config.ArchivePath, storage.ArchiveFormatZip)
+	case StorageTar:
+		store, err = storage.NewArchiveStorage(config.ArchivePath, storage.ArchiveFormatTar)
+	case StorageS3:
+		store, err = storage.NewS3Storage(
+			config.S3Endpoint, config.S3Region, config.S3Bucket,
+			config.S3AccessKey, config.S3SecretKey, config.S3Prefix, config.S3PathStyle,
+		)
+	default:
+		err = fmt.Errorf("不支持的存储类型: %s", config.Storage)
+	}
+	return
+}
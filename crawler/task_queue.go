@@ -1,77 +1,69 @@
 package crawler
 
-import "gitee.com/generals-space/site-mirror-go.git/model"
+import (
+	"gitee.com/generals-space/site-mirror-go.git/model"
+)
 
-// LoadTaskQueue 初始化任务队列, 读取数据库中的`PageTask`与`AssetTask`表,
-// 将其中缓存的任务加载到任务队列中
+// LoadTaskQueue 初始化任务队列, 任务都保存在数据库的url_records表中,
+// 这里只需要将上一次中断时未完成的任务恢复为等待状态, 并统计数量.
 func (crawler *Crawler) LoadTaskQueue() (err error) {
 	logger.Info("初始化任务队列")
-	crawler.DBClientMutex.Lock()
-	pageTasks, err := model.QueryUnfinishedPageTasks(crawler.DBClient)
-	crawler.DBClientMutex.Unlock()
+	err = crawler.Frontier.Load(crawler.Config.Update)
 	if err != nil {
-		logger.Errorf("获取页面任务失败: %s", err.Error())
+		logger.Errorf("加载任务队列失败: %s", err.Error())
 		return
 	}
-
-	logger.Debugf("获取页面队列任务数量: %d", len(pageTasks))
-	for _, task := range pageTasks {
-		crawler.PageQueue <- task
-		// crawler.EnqueuePage(task)
-	}
-
-	crawler.DBClientMutex.Lock()
-	assetTasks, err := model.QueryUnfinishedAssetTasks(crawler.DBClient)
-	crawler.DBClientMutex.Unlock()
-	if err != nil {
-		logger.Errorf("获取页面任务失败: %s", err.Error())
-		return
-	}
-
-	logger.Debugf("获取静态资源队列任务数量: %d", len(pageTasks))
-	for _, task := range assetTasks {
-		crawler.AssetQueue <- task
-		// crawler.EnqueueAsset(task)
-	}
-	logger.Infof("初始化任务队列完成, 页面任务数量: %d, 静态资源任务数量: %d", len(crawler.PageQueue), len(crawler.AssetQueue))
+	logger.Infof("初始化任务队列完成, 页面任务数量: %d, 静态资源任务数量: %d", crawler.Frontier.Queued(model.URLTypePage), crawler.Frontier.Queued(model.URLTypeAsset))
 	return
 }
 
 // EnqueuePage 页面任务入队列.
-// 入队列前查询数据库记录, 如已有记录则不再接受.
+// 入队列前检查url是否已经出现过(包括数据库中已有的记录), 如已出现过则不再接受.
+// 新任务入库时分配本地链接, 之后可以通过LookupLocalLink查询.
 // 已进入队列的任务, 必定已经存在记录, 但不一定能成功下载.
-// 由于队列长度有限, 这里可能会阻塞, 最可能发生死锁
-// 每个page worker在解析页面时, 会将页面中的链接全部入队列.
-// 如果此时队列已满, page worker就会阻塞, 当所有worker都阻塞到这里时, 程序就无法继续执行.
+// 任务直接写入数据库, 不会因为队列满而阻塞, 抓取被取消时也同样写入, 下次继续抓取时可以从数据库中加载.
 func (crawler *Crawler) EnqueuePage(req *model.URLRecord) {
-	var err error
-
-	crawler.PageQueue <- req
+	crawler.enqueue(req, "页面")
+}
 
-	crawler.DBClientMutex.Lock()
-	defer crawler.DBClientMutex.Unlock()
+// EnqueueAsset 静态资源任务入队列.
+// 入队列前检查url是否已经出现过(包括数据库中已有的记录), 如已出现过则不再接受.
+func (crawler *Crawler) EnqueueAsset(req *model.URLRecord) {
+	crawler.enqueue(req, "静态资源")
+}
 
-	err = model.AddOrUpdateURLRecord(crawler.DBClient, req)
+// enqueue 任务入队列, 入库时分配本地链接, 与其他url的本地链接冲突时记录日志.
+func (crawler *Crawler) enqueue(req *model.URLRecord, label string) {
+	err := crawler.defaultLocalLink(req)
 	if err != nil {
-		logger.Errorf("添加(更新)页面任务url记录失败, req: %+v, err: %s", req, err.Error())
+		logger.Errorf("转换为本地链接失败: req: %+v, error: %s", req, err.Error())
 		return
 	}
-	return
+	defaultLocalLink := req.LocalPath
+	added, err := crawler.Frontier.Push(req)
+	if err != nil {
+		logger.Errorf("添加%s任务url记录失败, req: %+v, err: %s", label, req, err.Error())
+		return
+	}
+	// 已经出现过的url同样记录引用关系, update模式中跳过没有变化的页面时需要据此遍历.
+	// 这里只暂存在内存中, 由引用它的文档解析完成后一次性写入数据库.
+	if req.Refer != "" {
+		crawler.references.add(req.Refer, req.URL, req.URLType)
+	}
+	if !added {
+		logger.Debugf("%s任务已存在, 不再入队列: %s", label, req.URL)
+		return
+	}
+	if req.LocalPath != defaultLocalLink {
+		logger.Infof("本地链接%s已被其他url占用, 改为%s: url: %s", defaultLocalLink, req.LocalPath, req.URL)
+	}
 }
 
-// EnqueueAsset 页面任务入队列.
-// 入队列前查询数据库记录, 如已有记录则不再接受.
-func (crawler *Crawler) EnqueueAsset(req *model.URLRecord) {
-	var err error
-	// 由于队列长度有限, 这里可能会阻塞
-	crawler.AssetQueue <- req
-
-	crawler.DBClientMutex.Lock()
-	defer crawler.DBClientMutex.Unlock()
-
-	err = model.AddOrUpdateURLRecord(crawler.DBClient, req)
+// requeue 请求失败的任务重新入队列, 更新失败次数, 并将状态修改为init
+func (crawler *Crawler) requeue(req *model.URLRecord) {
+	err := crawler.Frontier.Retry(req)
 	if err != nil {
-		logger.Errorf("添加(更新)静态资源任务url记录失败, req: %+v, err: %s", req, err.Error())
+		logger.Errorf("更新任务url记录失败, req: %+v, err: %s", req, err.Error())
 		return
 	}
 	return
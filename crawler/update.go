@@ -0,0 +1,253 @@
+package crawler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"gitee.com/generals-space/site-mirror-go.git/model"
+)
+
+// UpdateReport update模式结束时, 相对上一次抓取的变化
+type UpdateReport struct {
+	AddedPages   []string
+	ChangedPages []string
+	RemovedPages []string
+
+	AddedAssets   int
+	ChangedAssets int
+	RemovedAssets int
+}
+
+// fetchInfoOf 根据响应头与原始响应体生成需要保存的响应信息
+func fetchInfoOf(header http.Header, body []byte) (info *model.FetchInfo) {
+	hash := sha256.Sum256(body)
+	info = &model.FetchInfo{
+		ETag:          header.Get("ETag"),
+		LastModified:  header.Get("Last-Modified"),
+		ContentLength: int64(len(body)),
+		ContentHash:   hex.EncodeToString(hash[:]),
+	}
+	return
+}
+
+// localFileExists 判断任务对应的本地文件是否存在, 本地文件不存在时不能跳过下载.
+func (crawler *Crawler) localFileExists(req *model.URLRecord) bool {
+	localLink, err := crawler.localLinkOf(req)
+	if err != nil {
+		return false
+	}
+	exist, err := crawler.Storage.Exists(storageKeyOf(localLink))
+	if err != nil {
+		logger.Errorf("查询本地文件失败: req: %+v, error: %s", req, err.Error())
+		return false
+	}
+	return exist
+}
+
+// conditionalHeader update模式中, 为上一次抓取成功的任务生成条件请求头, 不需要时返回nil.
+func (crawler *Crawler) conditionalHeader(req *model.URLRecord) (header http.Header) {
+	if !crawler.Config.Update || req.UpdateState != model.UpdateStateUnvisited {
+		return
+	}
+	if req.ETag == "" && req.LastModified == "" {
+		return
+	}
+	if !crawler.localFileExists(req) {
+		return
+	}
+	header = http.Header{}
+	if req.ETag != "" {
+		header.Set("If-None-Match", req.ETag)
+	}
+	if req.LastModified != "" {
+		header.Set("If-Modified-Since", req.LastModified)
+	}
+	return
+}
+
+// isUnchanged update模式中, 判断200响应的内容与上一次抓取时是否相同.
+// 服务端不支持条件请求时, 通过内容哈希同样可以跳过没有变化的文件.
+func (crawler *Crawler) isUnchanged(req *model.URLRecord, info *model.FetchInfo) bool {
+	if !crawler.Config.Update || req.UpdateState != model.UpdateStateUnvisited {
+		return false
+	}
+	return req.ContentHash == info.ContentHash && crawler.localFileExists(req)
+}
+
+// markSuccess 任务成功完成, 保存响应信息. update模式中同时记录相对上一次抓取的变化.
+func (crawler *Crawler) markSuccess(req *model.URLRecord, info *model.FetchInfo) (err error) {
+	updateState := model.UpdateStateNone
+	if crawler.Config.Update {
+		switch {
+		case req.UpdateState != model.UpdateStateUnvisited:
+			updateState = model.UpdateStateAdded
+		case req.ContentHash == info.ContentHash:
+			updateState = model.UpdateStateUnchanged
+		default:
+			updateState = model.UpdateStateChanged
+		}
+	}
+	crawler.DBClientMutex.Lock()
+	err = model.SaveURLRecordFetchInfo(crawler.DBClient, req.URL, info, updateState)
+	crawler.DBClientMutex.Unlock()
+	return
+}
+
+// markUnchanged update模式中, 内容没有变化的任务直接标记为成功, 不再解析与重写本地文件.
+// info为nil(304响应)时保留上一次的响应信息.
+// 由于不再解析, 需要将上一次由它引用的页面与资源重新入队列, 以便继续遍历整个站点.
+func (crawler *Crawler) markUnchanged(ctx context.Context, req *model.URLRecord, info *model.FetchInfo) {
+	if info == nil {
+		info = &model.FetchInfo{
+			ETag:          req.ETag,
+			LastModified:  req.LastModified,
+			ContentLength: req.ContentLength,
+			ContentHash:   req.ContentHash,
+		}
+	}
+	// 没有重新存储, 本地链接保持不变
+	info.LocalPath = req.LocalPath
+	logger.Debugf("内容没有变化, 跳过: req: %+v", req)
+	crawler.enqueueChildren(ctx, req)
+	if ctx.Err() != nil {
+		return
+	}
+	err := crawler.markSuccess(req, info)
+	if err != nil {
+		logger.Errorf("更新任务记录状态失败: req: %+v, error: %s", req, err.Error())
+	}
+}
+
+// enqueueChildren 将上一次抓取时由req引用的页面与资源重新入队列, 仍然遵守当前的深度与过滤配置.
+// 不只是由req首次引用的url, 否则同时被其他(内容有变化且不再引用它的)页面引用的url会被误判为已删除.
+func (crawler *Crawler) enqueueChildren(ctx context.Context, req *model.URLRecord) {
+	// 原有的引用记录仍然有效, 重新入队列时收集的引用不需要写入
+	defer crawler.discardReferences(req)
+	crawler.DBClientMutex.Lock()
+	references, err := model.QueryURLReferences(crawler.DBClient, req.URL)
+	crawler.DBClientMutex.Unlock()
+	if err != nil {
+		logger.Errorf("查询子任务失败: req: %+v, error: %s", req, err.Error())
+		return
+	}
+	for _, reference := range references {
+		if reference.URLType == model.URLTypePage && 0 < crawler.Config.MaxDepth && crawler.Config.MaxDepth < req.Depth+1 {
+			continue
+		}
+		if !URLFilter(reference.URL, reference.URLType, crawler.Config) {
+			continue
+		}
+		task := &model.URLRecord{
+			URL:     reference.URL,
+			URLType: reference.URLType,
+			Refer:   req.URL,
+			Depth:   req.Depth + 1,
+		}
+		if reference.URLType == model.URLTypePage {
+			crawler.EnqueuePage(task)
+		} else {
+			crawler.EnqueueAsset(task)
+		}
+	}
+}
+
+// referenceBuffer 正在解析的文档(页面或css文件)中引用的url, 以文档的url为键.
+// 每个链接入队列时只记录在内存中, 文档解析完成后再一次性写入数据库.
+type referenceBuffer struct {
+	mutex     sync.Mutex
+	documents map[string]*documentReferences
+}
+
+// documentReferences 一个文档引用的url, 按照出现的顺序排列, 重复的引用只记录一次
+type documentReferences struct {
+	references []*model.URLReference
+	seen       map[model.URLReference]bool
+}
+
+func (buffer *referenceBuffer) add(refer string, url string, urlType int) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	if buffer.documents == nil {
+		buffer.documents = map[string]*documentReferences{}
+	}
+	document, ok := buffer.documents[refer]
+	if !ok {
+		document = &documentReferences{seen: map[model.URLReference]bool{}}
+		buffer.documents[refer] = document
+	}
+	key := model.URLReference{URL: url, URLType: urlType}
+	if document.seen[key] {
+		return
+	}
+	document.seen[key] = true
+	document.references = append(document.references, &model.URLReference{Refer: refer, URL: url, URLType: urlType})
+}
+
+// take 取出并清空refer引用的url
+func (buffer *referenceBuffer) take(refer string) (references []*model.URLReference) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	if document, ok := buffer.documents[refer]; ok {
+		references = document.references
+		delete(buffer.documents, refer)
+	}
+	return
+}
+
+// saveReferences 文档解析完成后, 用解析过程中收集的引用替换数据库中原有的记录, 不再引用的url不应再由它遍历到.
+func (crawler *Crawler) saveReferences(req *model.URLRecord) (err error) {
+	references := crawler.references.take(req.URL)
+	crawler.DBClientMutex.Lock()
+	err = model.ReplaceURLReferences(crawler.DBClient, req.URL, references)
+	crawler.DBClientMutex.Unlock()
+	return
+}
+
+// discardReferences 丢弃没有写入数据库的引用, 文档解析失败或被取消时, 数据库中原有的记录保持不变.
+func (crawler *Crawler) discardReferences(req *model.URLRecord) {
+	crawler.references.take(req.URL)
+}
+
+// finishUpdate update模式结束时, 将没有访问到的记录标记为已删除, 并统计变化.
+func (crawler *Crawler) finishUpdate() (report *UpdateReport, err error) {
+	crawler.DBClientMutex.Lock()
+	defer crawler.DBClientMutex.Unlock()
+	db := crawler.DBClient
+
+	err = model.MarkUnvisitedRemoved(db)
+	if err != nil {
+		return
+	}
+	report = &UpdateReport{}
+	report.AddedPages, err = model.QueryUpdatedURLs(db, model.URLTypePage, model.UpdateStateAdded)
+	if err != nil {
+		return
+	}
+	report.ChangedPages, err = model.QueryUpdatedURLs(db, model.URLTypePage, model.UpdateStateChanged)
+	if err != nil {
+		return
+	}
+	report.RemovedPages, err = model.QueryUpdatedURLs(db, model.URLTypePage, model.UpdateStateRemoved)
+	if err != nil {
+		return
+	}
+	var urls []string
+	for _, item := range []struct {
+		state int
+		count *int
+	}{
+		{model.UpdateStateAdded, &report.AddedAssets},
+		{model.UpdateStateChanged, &report.ChangedAssets},
+		{model.UpdateStateRemoved, &report.RemovedAssets},
+	} {
+		urls, err = model.QueryUpdatedURLs(db, model.URLTypeAsset, item.state)
+		if err != nil {
+			return
+		}
+		*item.count = len(urls)
+	}
+	return
+}
@@ -33,8 +33,9 @@ var charsetPatternInDOMStr = `charset\s*=\s*(\S*)\s*;?`
 // 但是只能作为判断是否匹配, 无法从中获取其他信息.
 var charsetPattern = regexp.MustCompile(charsetPatternInDOMStr)
 
-var cssAssetURLPatternStr = `url\(\'(.*?)\'\)|url\(\"(.*?)\"\)|url\((.*?)\)`
-var cssAssetURLPattern = regexp.MustCompile(cssAssetURLPatternStr)
-
 var emptyLinkPatternStr = `(^data:)|(^mailto:)|(about:blank)|(javascript:)`
 var emptyLinkPattern = regexp.MustCompile(emptyLinkPatternStr)
+
+// attrNamePattern 配置中的html属性名, 会被拼接为选择器, 只允许字母, 数字, 下划线与连字符
+var attrNamePatternStr = `^[a-zA-Z_][-a-zA-Z0-9_]*$`
+var attrNamePattern = regexp.MustCompile(attrNamePatternStr)
@@ -1,33 +1,49 @@
 package main
 
 import (
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-
-	"gitee.com/generals-space/site-mirror-go.git/crawler"
-	"gitee.com/generals-space/site-mirror-go.git/util"
 )
 
-func main() {
-	logger := util.NewLogger(os.Stdout)
-	// logger.SetLevel("debug")
+var usage = `site-mirror-go 整站下载工具
+
+用法:
+	site-mirror-go <command> [options]
+
+子命令:
+	mirror	从起始页面开始抓取站点
+	resume	从数据库中记录的未完成任务继续抓取
+	update	使用条件请求重新遍历已抓取的站点, 只更新有变化的文件, 并报告新增, 修改与删除的页面
+	status	查看数据库中的任务统计
+	serve	启动静态服务器浏览已下载的站点
 
-	config := crawler.NewConfig()
-	config.StartPage = "https://www.lewenxiaoshuo.com/"
-	config.UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/73.0.3683.86 Safari/537.36"
-	config.MaxDepth = 1
+使用 "site-mirror-go <command> -h" 查看子命令的选项.
+`
 
-	c, err := crawler.NewCrawler(config, logger)
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "mirror", "resume", "update":
+		err = runMirror(args, os.Args[1])
+	case "status":
+		err = runStatus(args)
+	case "serve":
+		err = runServe(args)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "未知的子命令: %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
 	}
-	c.Start()
-	defer func() {
-		logger.Info("用户取消")
-	}()
-	// 等待用户取消, 目前无法自动结束.
-	channel := make(chan os.Signal)
-	signal.Notify(channel, syscall.SIGINT, syscall.SIGTERM)
-	logger.Info(<-channel)
 }
@@ -1,6 +1,8 @@
 package model
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite" // 注释防止绿色下划线语法提示
 )
@@ -12,8 +14,10 @@ const (
 	URLTaskStatusPending
 	// URLTaskStatusSuccess 任务状态成功, 2
 	URLTaskStatusSuccess
-	// URLTaskStatusFailed 任务状态失败(404), 3
+	// URLTaskStatusFailed 任务状态失败(4xx, 或重试次数用尽), 3
 	URLTaskStatusFailed
+	// URLTaskStatusSkipped 根据响应的实际类型, 被NoJs, NoImages等开关排除, 4
+	URLTaskStatusSkipped
 )
 
 const (
@@ -21,23 +25,96 @@ const (
 	URLTypeAsset
 )
 
+// update模式中记录相对上一次抓取的变化
+const (
+	// UpdateStateNone 非update模式, 或update开始前就不是成功状态的记录, 0
+	UpdateStateNone = iota
+	// UpdateStateUnvisited update开始前为成功状态, 本次还未访问到, 1
+	UpdateStateUnvisited
+	// UpdateStateAdded 本次新增(或之前未成功)的记录, 2
+	UpdateStateAdded
+	// UpdateStateChanged 内容有变化, 3
+	UpdateStateChanged
+	// UpdateStateUnchanged 内容没有变化(304, 或内容哈希相同), 4
+	UpdateStateUnchanged
+	// UpdateStateRemoved 之前抓取成功, 本次已经访问不到(4xx, 或不再被任何页面引用), 5
+	UpdateStateRemoved
+)
+
 // URLRecord 任务记录表
 type URLRecord struct {
 	gorm.Model
 	URL         string `gorm:"unique, not null"`
-	Refer       string
+	Refer       string `gorm:"index"`
 	Depth       int
-	URLType     int
+	URLType     int `gorm:"index:idx_url_records_type_status"`
 	FailedTimes int
-	Status      int `gorm:"default 0"`
+	Status      int `gorm:"default 0;index:idx_url_records_type_status"`
+	// 失败后下一次允许重试的时间(UTC), 为空时表示可以立即抓取
+	NextAttemptAt *time.Time
+
+	// 上一次成功抓取时的响应信息, 用于update模式的条件请求与变化检测.
+	// ContentHash为原始响应体的sha256.
+	ETag          string `gorm:"column:etag"`
+	LastModified  string
+	ContentLength int64
+	ContentHash   string
+	UpdateState   int
+	// 本地链接(以斜线开头), 入队列时分配, 所有链接改写都以此为准.
+	// 与其他url的本地链接冲突时(如/a?b与/awhb)在扩展名前追加url的哈希值.
+	// 资源根据Content-Type追加扩展名后会更新为实际存储的链接.
+	LocalPath string `gorm:"unique_index"`
+	// 入队列时分配的本地链接, 在LocalPath更新之前解析的页面与css中引用的是这个链接
+	OriginLocalPath string `gorm:"index"`
 }
 
-// GetDB 获取数据库链接
-func GetDB(dbPath string) (db *gorm.DB, err error) {
+// URLReference 页面(或css文件)对url的引用关系, 同一个url被多个页面引用时每个页面各有一条记录.
+// URLRecord.Refer只保存首次引用它的页面, update模式跳过没有变化的页面时需要根据这里的记录重新入队列.
+type URLReference struct {
+	ID      uint   `gorm:"primary_key"`
+	Refer   string `gorm:"not null;unique_index:idx_url_references_refer_url_type"`
+	URL     string `gorm:"not null;unique_index:idx_url_references_refer_url_type"`
+	URLType int    `gorm:"unique_index:idx_url_references_refer_url_type"`
+}
+
+// FetchInfo 抓取成功时记录的响应信息
+type FetchInfo struct {
+	ETag          string
+	LastModified  string
+	ContentLength int64
+	ContentHash   string
+	// 实际存储的本地链接
+	LocalPath string
+}
+
+// OpenDB 只打开数据库链接, 不修改表结构, 用于status等只读的子命令.
+func OpenDB(dbPath string) (db *gorm.DB, err error) {
 	db, err = gorm.Open("sqlite3", dbPath)
+	return
+}
+
+// GetDB 获取数据库链接, 并建立或升级表结构
+func GetDB(dbPath string) (db *gorm.DB, err error) {
+	db, err = OpenDB(dbPath)
+	if err != nil {
+		return
+	}
+	// 旧版本中未分配本地链接的记录为空字符串, 需要改为NULL才能建立唯一索引, 之后重新分配.
+	if db.HasTable(&URLRecord{}) && db.Dialect().HasColumn("url_records", "local_path") {
+		err = db.Model(&URLRecord{}).Where("local_path = ?", "").UpdateColumn("local_path", gorm.Expr("NULL")).Error
+		if err != nil {
+			return
+		}
+	}
+	// 旧版本中没有引用关系表, 根据记录中的首次引用补全, update模式至少可以按原来的方式遍历
+	backfillReferences := db.HasTable(&URLRecord{}) && !db.HasTable(&URLReference{})
 	tables := []interface{}{
 		&URLRecord{},
+		&URLReference{},
 	}
 	db.AutoMigrate(tables...)
+	if backfillReferences {
+		err = db.Exec("insert into url_references (refer, url, url_type) select refer, url, url_type from url_records where refer <> '' and deleted_at is null").Error
+	}
 	return
 }
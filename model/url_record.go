@@ -1,50 +1,137 @@
 package model
 
-import "github.com/jinzhu/gorm"
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path"
+	"time"
 
-// isExistInURLRecord 查询数据库中指定的url任务记录, 判断是否已存在
-func isExistInURLRecord(db *gorm.DB, url string) bool {
-	var err error
-	var count int
-	err = db.Table("url_records").Where("url = ?", url).Count(&count).Error
-	if err != nil || count == 0 {
-		return false
-	}
-	return true
+	"github.com/jinzhu/gorm"
+)
+
+// ResetPendingURLRecords 将pending状态的任务重置为init状态.
+// pending状态的任务是上一次抓取中断时正在处理的任务, 继续抓取时需要重新处理.
+func ResetPendingURLRecords(db *gorm.DB) (err error) {
+	err = db.Model(&URLRecord{}).Where("status = ?", URLTaskStatusPending).UpdateColumn("status", URLTaskStatusInit).Error
+	return
 }
 
-// queryUnfinishedTasks ...
-func queryUnfinishedTasks(db *gorm.DB, urlType int) (tasks []*URLRecord, err error) {
-	tasks = []*URLRecord{}
-	err = db.Where("url_type = ? and status in (?)", urlType, []int{URLTaskStatusInit, URLTaskStatusPending}).Find(&tasks).Error
+// CountQueuedURLRecords 查询指定类型的init状态(等待抓取)的任务数量
+func CountQueuedURLRecords(db *gorm.DB, urlType int) (count int, err error) {
+	err = db.Model(&URLRecord{}).Where("url_type = ? and status = ?", urlType, URLTaskStatusInit).Count(&count).Error
 	return
 }
 
-// QueryUnfinishedPageTasks ...
-func QueryUnfinishedPageTasks(db *gorm.DB) (tasks []*URLRecord, err error) {
-	return queryUnfinishedTasks(db, URLTypePage)
+// PopURLRecord 取出指定类型的最早入库且已到重试时间的init状态任务, 并将其状态修改为pending.
+// 没有可取的任务时返回gorm.ErrRecordNotFound.
+func PopURLRecord(db *gorm.DB, urlType int, now time.Time) (task *URLRecord, err error) {
+	task = &URLRecord{}
+	err = db.Where("url_type = ? and status = ?", urlType, URLTaskStatusInit).
+		Where("next_attempt_at is null or next_attempt_at <= ?", now.UTC()).
+		Order("id").First(task).Error
+	if err != nil {
+		return
+	}
+	err = db.Model(task).UpdateColumn("status", URLTaskStatusPending).Error
+	return
 }
 
-// QueryUnfinishedAssetTasks ...
-func QueryUnfinishedAssetTasks(db *gorm.DB) (tasks []*URLRecord, err error) {
-	return queryUnfinishedTasks(db, URLTypeAsset)
+// QueryNextAttemptAt 查询指定类型的init状态任务中最早的重试时间, 没有等待重试的任务时返回nil.
+func QueryNextAttemptAt(db *gorm.DB, urlType int) (nextAttemptAt *time.Time, err error) {
+	task := &URLRecord{}
+	err = db.Where("url_type = ? and status = ? and next_attempt_at is not null", urlType, URLTaskStatusInit).
+		Order("next_attempt_at").First(task).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = nil
+		return
+	}
+	nextAttemptAt = task.NextAttemptAt
+	return
 }
 
-// AddOrUpdateURLRecord 任务入队列时添加URLRecord新记录(如果已存在则更新failed_times和status字段)
-func AddOrUpdateURLRecord(db *gorm.DB, task *URLRecord) (err error) {
-	exist := isExistInURLRecord(db, task.URL)
-	if exist {
-		whereArgs := map[string]interface{}{
-			"url": task.URL,
+// EachURL 遍历数据库中所有任务记录的url与任务类型, 逐行读取, 不会一次性加载到内存.
+func EachURL(db *gorm.DB, handler func(url string, urlType int)) (err error) {
+	rows, err := db.Model(&URLRecord{}).Select("url, url_type").Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		var urlType int
+		err = rows.Scan(&url, &urlType)
+		if err != nil {
+			return
 		}
+		handler(url, urlType)
+	}
+	err = rows.Err()
+	return
+}
+
+// AddOrUpdateURLRecord 任务入队列时添加URLRecord新记录(如果已存在则更新failed_times, next_attempt_at和status字段)
+// 添加新记录时task.LocalPath为默认的本地链接, 与已有记录冲突时会被修改, 已有记录的本地链接保持不变.
+// @return: queued 任务是否由其他状态变为init状态(即等待抓取的任务数是否增加)
+func AddOrUpdateURLRecord(db *gorm.DB, task *URLRecord) (queued bool, err error) {
+	record := &URLRecord{}
+	err = db.Where("url = ?", task.URL).First(record).Error
+	if err == nil {
 		dataToBeUpdated := map[string]interface{}{
-			"failed_times": task.FailedTimes,
-			"status":       URLTaskStatusInit, // 任务重新入队列要将状态修改为init状态
+			"failed_times":    task.FailedTimes,
+			"next_attempt_at": task.NextAttemptAt,
+			"status":          URLTaskStatusInit, // 任务重新入队列要将状态修改为init状态
+		}
+		// Updates()会将新值写回record中, 需要事先记录原状态
+		queued = record.Status != URLTaskStatusInit
+		// 同一个url既作为页面又作为静态资源出现时以页面为准, 页面需要被解析.
+		// task.URLType修改为记录实际的类型, 调用者以此统计等待中的任务数量.
+		if task.URLType == URLTypePage && record.URLType != URLTypePage {
+			dataToBeUpdated["url_type"] = URLTypePage
+			dataToBeUpdated["depth"] = task.Depth
+			queued = true
+		} else {
+			task.URLType = record.URLType
 		}
-		err = db.Model(&URLRecord{}).Where(whereArgs).Updates(dataToBeUpdated).Error
-	} else {
+		err = db.Model(record).Updates(dataToBeUpdated).Error
+	} else if gorm.IsRecordNotFoundError(err) {
+		task.Status = URLTaskStatusInit
+		task.LocalPath, err = uniqueLocalPath(db, task.URL, task.LocalPath)
+		if err != nil {
+			return
+		}
+		task.OriginLocalPath = task.LocalPath
 		err = db.Create(task).Error
+		queued = true
+	}
+	if err != nil {
+		queued = false
+	}
+	return
+}
+
+// PromoteURLRecord 将已有的静态资源记录改为页面任务, 重置为init状态重新入队列.
+// 用于先作为静态资源(如<embed>, css中的url())出现, 之后又被<a>引用的url, 页面需要被解析才能继续抓取其中的链接.
+// 本地链接保持不变, 已存储的页面与css中引用的都是这个链接.
+// 记录为pending状态(正在被处理)时不修改, 由调用者在处理完成后再次调用.
+// @return: status 修改前的任务状态
+func PromoteURLRecord(db *gorm.DB, url string, depth int) (status int, err error) {
+	record := &URLRecord{}
+	err = db.Where("url = ?", url).First(record).Error
+	if err != nil {
+		return
 	}
+	status = record.Status
+	if record.URLType == URLTypePage || status == URLTaskStatusPending {
+		return
+	}
+	dataToBeUpdated := map[string]interface{}{
+		"url_type":        URLTypePage,
+		"depth":           depth,
+		"failed_times":    0,
+		"next_attempt_at": nil,
+		"status":          URLTaskStatusInit,
+	}
+	err = db.Model(record).Updates(dataToBeUpdated).Error
 	return
 }
 
@@ -59,3 +146,173 @@ func UpdateURLRecordStatus(db *gorm.DB, url string, status int) (err error) {
 	err = db.Model(urlRecord).UpdateColumn("status", status).Error
 	return
 }
+
+// SaveURLRecordFetchInfo 抓取成功时将记录标记为成功, 并保存响应信息与update状态
+func SaveURLRecordFetchInfo(db *gorm.DB, url string, info *FetchInfo, updateState int) (err error) {
+	dataToBeUpdated := map[string]interface{}{
+		"status":         URLTaskStatusSuccess,
+		"etag":           info.ETag,
+		"last_modified":  info.LastModified,
+		"content_length": info.ContentLength,
+		"content_hash":   info.ContentHash,
+		"local_path":     info.LocalPath,
+		"update_state":   updateState,
+	}
+	err = db.Model(&URLRecord{}).Where("url = ?", url).UpdateColumns(dataToBeUpdated).Error
+	return
+}
+
+// UpdateURLRecordUpdateState 更新记录的update状态
+func UpdateURLRecordUpdateState(db *gorm.DB, url string, updateState int) (err error) {
+	err = db.Model(&URLRecord{}).Where("url = ?", url).UpdateColumn("update_state", updateState).Error
+	return
+}
+
+// ResetUpdateStates update开始前重置所有记录的update状态,
+// 成功状态的记录标记为未访问, 其他记录标记为无.
+func ResetUpdateStates(db *gorm.DB) (err error) {
+	err = db.Model(&URLRecord{}).Where("status = ?", URLTaskStatusSuccess).UpdateColumn("update_state", UpdateStateUnvisited).Error
+	if err != nil {
+		return
+	}
+	err = db.Model(&URLRecord{}).Where("status <> ?", URLTaskStatusSuccess).UpdateColumn("update_state", UpdateStateNone).Error
+	return
+}
+
+// MarkUnvisitedRemoved update结束时, 仍未访问到的记录标记为已删除
+func MarkUnvisitedRemoved(db *gorm.DB) (err error) {
+	err = db.Model(&URLRecord{}).Where("update_state = ?", UpdateStateUnvisited).UpdateColumn("update_state", UpdateStateRemoved).Error
+	return
+}
+
+// QueryUpdatedURLs 查询指定类型与update状态的记录的url
+func QueryUpdatedURLs(db *gorm.DB, urlType int, updateState int) (urls []string, err error) {
+	urls = []string{}
+	err = db.Model(&URLRecord{}).Where("url_type = ? and update_state = ?", urlType, updateState).Order("id").Pluck("url", &urls).Error
+	return
+}
+
+// EachSuccessURLRecord 遍历所有成功状态的记录, 逐行读取, 不会一次性加载到内存.
+func EachSuccessURLRecord(db *gorm.DB, handler func(task *URLRecord)) (err error) {
+	rows, err := db.Model(&URLRecord{}).Where("status = ?", URLTaskStatusSuccess).Order("id").Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		task := &URLRecord{}
+		err = db.ScanRows(rows, task)
+		if err != nil {
+			return
+		}
+		handler(task)
+	}
+	err = rows.Err()
+	return
+}
+
+// QueryStartPage 获取最早入库的第1层页面记录, 即上一次抓取的起始页面.
+func QueryStartPage(db *gorm.DB) (task *URLRecord, err error) {
+	task = &URLRecord{}
+	err = db.Where("url_type = ? and depth = ?", URLTypePage, 1).Order("id").First(task).Error
+	return
+}
+
+// URLRecordCount 按任务类型与状态分组的记录数量
+type URLRecordCount struct {
+	URLType int
+	Status  int
+	Count   int
+}
+
+// CountURLRecords 统计各类型各状态的任务数量
+func CountURLRecords(db *gorm.DB) (counts []*URLRecordCount, err error) {
+	counts = []*URLRecordCount{}
+	err = db.Table("url_records").
+		Select("url_type, status, count(*) as count").
+		Where("deleted_at is null").
+		Group("url_type, status").
+		Scan(&counts).Error
+	return
+}
+
+// QueryLocalPath 查询url对应的本地链接, 没有记录时返回gorm.ErrRecordNotFound.
+func QueryLocalPath(db *gorm.DB, url string) (localPath string, err error) {
+	task := &URLRecord{}
+	err = db.Select("local_path").Where("url = ?", url).First(task).Error
+	localPath = task.LocalPath
+	return
+}
+
+// QueryURLRecord 查询url对应的任务记录, 没有记录时返回gorm.ErrRecordNotFound.
+func QueryURLRecord(db *gorm.DB, url string) (task *URLRecord, err error) {
+	task = &URLRecord{}
+	err = db.Where("url = ?", url).First(task).Error
+	return
+}
+
+// QueryURLRecordByLocalPath 查询本地链接对应的任务记录, 优先匹配当前的本地链接, 其次是入队列时分配的本地链接.
+// 没有记录时返回gorm.ErrRecordNotFound.
+func QueryURLRecordByLocalPath(db *gorm.DB, localPath string) (task *URLRecord, err error) {
+	task = &URLRecord{}
+	err = db.Where("local_path = ?", localPath).First(task).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		return
+	}
+	task = &URLRecord{}
+	err = db.Where("origin_local_path = ?", localPath).First(task).Error
+	return
+}
+
+// RelocateLocalPath 修改url对应的本地链接(如根据Content-Type追加扩展名), 冲突时同样追加哈希值, 返回最终的本地链接.
+// 入队列时分配的origin_local_path保持不变.
+func RelocateLocalPath(db *gorm.DB, url string, localPath string) (finalPath string, err error) {
+	finalPath, err = uniqueLocalPath(db, url, localPath)
+	if err != nil {
+		return
+	}
+	err = db.Model(&URLRecord{}).Where("url = ?", url).UpdateColumn("local_path", finalPath).Error
+	return
+}
+
+// QueryURLRecordsWithoutLocalPath 查询旧版本数据库中还没有分配本地链接的记录
+func QueryURLRecordsWithoutLocalPath(db *gorm.DB) (tasks []*URLRecord, err error) {
+	tasks = []*URLRecord{}
+	err = db.Where("local_path is null or local_path = ?", "").Order("id").Find(&tasks).Error
+	return
+}
+
+// AssignLocalPath 为没有本地链接的记录分配本地链接, 冲突时追加哈希值.
+func AssignLocalPath(db *gorm.DB, url string, localPath string) (finalPath string, err error) {
+	finalPath, err = uniqueLocalPath(db, url, localPath)
+	if err != nil {
+		return
+	}
+	err = db.Model(&URLRecord{}).Where("url = ?", url).UpdateColumns(map[string]interface{}{
+		"local_path":        finalPath,
+		"origin_local_path": finalPath,
+	}).Error
+	return
+}
+
+// uniqueLocalPath 检查本地链接是否已被其他url占用(包括其他记录入队列时分配的链接),
+// 被占用时在扩展名前追加url的sha1哈希值, 如/awhb.html -> /awhb-1a2b3c4d.html, 仍然冲突时使用更长的哈希值.
+func uniqueLocalPath(db *gorm.DB, url string, localPath string) (finalPath string, err error) {
+	hash := sha1.Sum([]byte(url))
+	suffix := hex.EncodeToString(hash[:])
+	finalPath = localPath
+	for _, length := range []int{0, 8, 16, len(suffix)} {
+		if length > 0 {
+			ext := path.Ext(localPath)
+			finalPath = localPath[:len(localPath)-len(ext)] + "-" + suffix[:length] + ext
+		}
+		count := 0
+		err = db.Model(&URLRecord{}).
+			Where("local_path = ? or origin_local_path = ?", finalPath, finalPath).
+			Where("url <> ?", url).Count(&count).Error
+		if err != nil || count == 0 {
+			return
+		}
+	}
+	return
+}
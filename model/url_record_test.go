@@ -0,0 +1,154 @@
+package model
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+func newTestDB(t *testing.T) (db *gorm.DB, cleanup func()) {
+	dir, err := ioutil.TempDir("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = GetDB(filepath.Join(dir, "site.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// urlHash 返回url的sha1哈希值的前length位
+func urlHash(url string, length int) string {
+	hash := sha1.Sum([]byte(url))
+	return hex.EncodeToString(hash[:])[:length]
+}
+
+// addRecord 直接写入一条指定本地链接的记录, 不经过冲突检查
+func addRecord(t *testing.T, db *gorm.DB, url string, localPath string, originLocalPath string) {
+	err := db.Create(&URLRecord{URL: url, LocalPath: localPath, OriginLocalPath: originLocalPath}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUniqueLocalPath(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	url := "http://example.com/a?b"
+	addRecord(t, db, "http://example.com/awhb", "/awhb.html", "/awhb.html")
+	addRecord(t, db, "http://example.com/other", "/other-new.html", "/other.html")
+	addRecord(t, db, "http://example.com/self", "/self.html", "/self.html")
+	addRecord(t, db, "http://example.com/dir.v2/page", "/dir.v2/page", "/dir.v2/page")
+
+	tests := []struct {
+		url       string
+		localPath string
+		want      string
+	}{
+		// 没有冲突时保持不变
+		{url, "/free.html", "/free.html"},
+		// 哈希值追加在扩展名之前
+		{url, "/awhb.html", "/awhb-" + urlHash(url, 8) + ".html"},
+		// 没有扩展名时追加在末尾
+		{url, "/dir.v2/page", "/dir.v2/page-" + urlHash(url, 8)},
+		// 与其他记录入队列时分配的链接冲突同样追加哈希值
+		{url, "/other.html", "/other-" + urlHash(url, 8) + ".html"},
+		{url, "/other-new.html", "/other-new-" + urlHash(url, 8) + ".html"},
+		// 自己的记录不算冲突
+		{"http://example.com/self", "/self.html", "/self.html"},
+	}
+	for _, test := range tests {
+		finalPath, err := uniqueLocalPath(db, test.url, test.localPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finalPath != test.want {
+			t.Errorf("uniqueLocalPath(%s, %s) = %s, 应为%s", test.url, test.localPath, finalPath, test.want)
+		}
+	}
+}
+
+// 追加的哈希值仍然冲突时依次使用8位, 16位与完整的40位哈希值
+func TestUniqueLocalPathLongerHash(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	url := "http://example.com/a?b"
+	addRecord(t, db, "http://example.com/awhb", "/awhb.html", "/awhb.html")
+	wants := []string{
+		"/awhb-" + urlHash(url, 8) + ".html",
+		"/awhb-" + urlHash(url, 16) + ".html",
+		"/awhb-" + urlHash(url, 40) + ".html",
+	}
+	for i, want := range wants {
+		finalPath, err := uniqueLocalPath(db, url, "/awhb.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if finalPath != want {
+			t.Errorf("第%d次冲突时uniqueLocalPath() = %s, 应为%s", i+1, finalPath, want)
+		}
+		// 让其他url占用这个链接
+		addRecord(t, db, "http://example.com/taken"+want, want, want)
+	}
+}
+
+func TestAddOrUpdateURLRecordLocalPath(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	tasks := []struct {
+		url       string
+		localPath string
+		want      string
+	}{
+		{"http://example.com/awhb", "/awhb.html", "/awhb.html"},
+		{"http://example.com/a?b", "/awhb.html", "/awhb-" + urlHash("http://example.com/a?b", 8) + ".html"},
+		// 已存在的记录重新入队列时本地链接不变
+		{"http://example.com/awhb", "/changed.html", "/awhb.html"},
+	}
+	for _, test := range tasks {
+		_, err := AddOrUpdateURLRecord(db, &URLRecord{URL: test.url, LocalPath: test.localPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		localPath, err := QueryLocalPath(db, test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if localPath != test.want {
+			t.Errorf("%s的本地链接为%s, 应为%s", test.url, localPath, test.want)
+		}
+	}
+
+	// 修改本地链接时冲突同样追加哈希值, 入队列时分配的链接保持不变
+	url := "http://example.com/style"
+	_, err := AddOrUpdateURLRecord(db, &URLRecord{URL: url, LocalPath: "/style"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finalPath, err := RelocateLocalPath(db, url, "/awhb.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/awhb-" + urlHash(url, 8) + ".html"; finalPath != want {
+		t.Errorf("RelocateLocalPath() = %s, 应为%s", finalPath, want)
+	}
+	record := &URLRecord{}
+	db.Where("url = ?", url).First(record)
+	if record.LocalPath != finalPath || record.OriginLocalPath != "/style" {
+		t.Errorf("local_path = %s, origin_local_path = %s", record.LocalPath, record.OriginLocalPath)
+	}
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxReferencesPerInsert 每条insert语句写入的引用记录数, sqlite每条语句最多999个参数
+const maxReferencesPerInsert = 300
+
+// ReplaceURLReferences 在一个事务中删除refer原有的引用记录, 并批量写入新的引用记录, 重复的记录忽略.
+// 页面(或css文件)解析完成后调用, 不再引用的url不会再由它遍历到.
+func ReplaceURLReferences(db *gorm.DB, refer string, references []*URLReference) (err error) {
+	tx := db.Begin()
+	err = tx.Error
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	err = tx.Where("refer = ?", refer).Delete(&URLReference{}).Error
+	if err != nil {
+		return
+	}
+	for start := 0; start < len(references); start += maxReferencesPerInsert {
+		end := start + maxReferencesPerInsert
+		if end > len(references) {
+			end = len(references)
+		}
+		placeholders := make([]string, 0, end-start)
+		values := make([]interface{}, 0, 3*(end-start))
+		for _, reference := range references[start:end] {
+			placeholders = append(placeholders, "(?, ?, ?)")
+			values = append(values, refer, reference.URL, reference.URLType)
+		}
+		err = tx.Exec("insert or ignore into url_references (refer, url, url_type) values "+strings.Join(placeholders, ", "), values...).Error
+		if err != nil {
+			return
+		}
+	}
+	err = tx.Commit().Error
+	return
+}
+
+// QueryURLReferences 查询refer引用的所有url
+func QueryURLReferences(db *gorm.DB, refer string) (references []*URLReference, err error) {
+	references = []*URLReference{}
+	err = db.Where("refer = ?", refer).Order("id").Find(&references).Error
+	return
+}
@@ -0,0 +1,141 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// referencesOf 返回refer引用的url与类型, 如["http://a/x.css:1"]
+func referencesOf(t *testing.T, db *gorm.DB, refer string) (urls []string) {
+	references, err := QueryURLReferences(db, refer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls = []string{}
+	for _, reference := range references {
+		urls = append(urls, reference.URL+":"+string('0'+rune(reference.URLType)))
+	}
+	return
+}
+
+func TestReplaceURLReferences(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	replace := func(refer string, references []*URLReference) {
+		err := ReplaceURLReferences(db, refer, references)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace("http://a/", []*URLReference{
+		{URL: "http://a/p1", URLType: URLTypePage},
+		{URL: "http://a/x.css", URLType: URLTypeAsset},
+		// 重复的引用只记录一次
+		{URL: "http://a/p1", URLType: URLTypePage},
+		// 同一个url既作为页面又作为静态资源引用
+		{URL: "http://a/x.css", URLType: URLTypePage},
+	})
+	// 被多个页面引用
+	replace("http://a/p2", []*URLReference{{URL: "http://a/p1", URLType: URLTypePage}})
+
+	tests := []struct {
+		refer string
+		want  []string
+	}{
+		{"http://a/", []string{"http://a/p1:0", "http://a/x.css:1", "http://a/x.css:0"}},
+		{"http://a/p2", []string{"http://a/p1:0"}},
+		{"http://a/p1", []string{}},
+	}
+	for _, test := range tests {
+		if urls := referencesOf(t, db, test.refer); !reflect.DeepEqual(urls, test.want) {
+			t.Errorf("%s的引用为%v, 应为%v", test.refer, urls, test.want)
+		}
+	}
+
+	// 替换时删除不再引用的url, 其他页面的引用不受影响
+	replace("http://a/", []*URLReference{{URL: "http://a/x.css", URLType: URLTypeAsset}})
+	if urls := referencesOf(t, db, "http://a/"); !reflect.DeepEqual(urls, []string{"http://a/x.css:1"}) {
+		t.Errorf("替换后http://a/的引用为%v, 应为[http://a/x.css:1]", urls)
+	}
+	replace("http://a/", nil)
+	if urls := referencesOf(t, db, "http://a/"); len(urls) != 0 {
+		t.Errorf("替换后http://a/的引用为%v, 应为空", urls)
+	}
+	if urls := referencesOf(t, db, "http://a/p2"); !reflect.DeepEqual(urls, []string{"http://a/p1:0"}) {
+		t.Errorf("http://a/p2的引用为%v, 不应被删除", urls)
+	}
+
+	// 超过单条insert语句的记录数时分批写入
+	references := []*URLReference{}
+	for i := 0; i < maxReferencesPerInsert*2+1; i++ {
+		references = append(references, &URLReference{URL: fmt.Sprintf("http://a/p%d", i), URLType: URLTypePage})
+	}
+	replace("http://a/", references)
+	if urls := referencesOf(t, db, "http://a/"); len(urls) != len(references) {
+		t.Errorf("http://a/的引用数量为%d, 应为%d", len(urls), len(references))
+	}
+}
+
+// 旧版本数据库中没有引用关系表, 升级时根据首次引用补全
+func TestGetDBBackfillsReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "site.db")
+
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.AutoMigrate(&URLRecord{})
+	records := []*URLRecord{
+		{URL: "http://a/", LocalPath: "/index.html"},
+		{URL: "http://a/p1", Refer: "http://a/", URLType: URLTypePage, LocalPath: "/p1.html"},
+		{URL: "http://a/x.css", Refer: "http://a/p1", URLType: URLTypeAsset, LocalPath: "/x.css"},
+	}
+	for _, record := range records {
+		err = db.Create(record).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = GetDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tests := []struct {
+		refer string
+		want  []string
+	}{
+		{"http://a/", []string{"http://a/p1:0"}},
+		{"http://a/p1", []string{"http://a/x.css:1"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		if urls := referencesOf(t, db, test.refer); !reflect.DeepEqual(urls, test.want) {
+			t.Errorf("%s的引用为%v, 应为%v", test.refer, urls, test.want)
+		}
+	}
+
+	// 再次打开时不重复补全
+	db.Close()
+	db, err = GetDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := referencesOf(t, db, "http://a/"); len(urls) != 1 {
+		t.Errorf("再次打开后http://a/的引用为%v", urls)
+	}
+}
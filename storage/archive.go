@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ArchiveFormatZip zip归档
+	ArchiveFormatZip = "zip"
+	// ArchiveFormatTar tar归档, 文件名以.gz或.tgz结尾时使用gzip压缩
+	ArchiveFormatTar = "tar"
+)
+
+// ArchiveStorage 将整个站点存储为单个zip或tar归档文件.
+// 归档文件只能顺序写入, 无法覆盖或读取其中的文件, 所以抓取过程中的文件先存放在归档文件旁的
+// `<ArchivePath>.staging`暂存目录中, Close()时再统一打包, 成功后删除暂存目录.
+// 如果打开时暂存目录不存在而归档文件已存在(如继续上一次的抓取), 会先将归档文件解压到暂存目录.
+type ArchiveStorage struct {
+	*LocalStorage
+	ArchivePath string
+	Format      string
+}
+
+// NewArchiveStorage ...
+func NewArchiveStorage(archivePath string, format string) (storage *ArchiveStorage, err error) {
+	if format != ArchiveFormatZip && format != ArchiveFormatTar {
+		err = fmt.Errorf("不支持的归档格式: %s", format)
+		return
+	}
+	storage = &ArchiveStorage{
+		LocalStorage: NewLocalStorage(archivePath + ".staging"),
+		ArchivePath:  archivePath,
+		Format:       format,
+	}
+
+	_, err = os.Stat(storage.BaseDir)
+	if err == nil || !os.IsNotExist(err) {
+		return
+	}
+	_, err = os.Stat(archivePath)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if format == ArchiveFormatZip {
+		err = storage.extractZip()
+	} else {
+		err = storage.extractTar()
+	}
+	return
+}
+
+func (storage *ArchiveStorage) isGzip() bool {
+	return strings.HasSuffix(storage.ArchivePath, ".gz") || strings.HasSuffix(storage.ArchivePath, ".tgz")
+}
+
+func (storage *ArchiveStorage) extractZip() (err error) {
+	reader, err := zip.OpenReader(storage.ArchivePath)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		var fileReader io.ReadCloser
+		fileReader, err = file.Open()
+		if err != nil {
+			return
+		}
+		var content []byte
+		content, err = ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return
+		}
+		err = storage.Put(file.Name, content)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (storage *ArchiveStorage) extractTar() (err error) {
+	file, err := os.Open(storage.ArchivePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if storage.isGzip() {
+		var gzipReader *gzip.Reader
+		gzipReader, err = gzip.NewReader(file)
+		if err != nil {
+			return
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		var header *tar.Header
+		header, err = tarReader.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		var content []byte
+		content, err = ioutil.ReadAll(tarReader)
+		if err != nil {
+			return
+		}
+		err = storage.Put(header.Name, content)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close 将暂存目录中的文件打包为归档文件, 成功后删除暂存目录.
+// 先写入临时文件再重命名, 打包中途出错时不会破坏已有的归档文件.
+func (storage *ArchiveStorage) Close() (err error) {
+	filePaths, err := storage.List("")
+	if err != nil {
+		return
+	}
+	tmpArchivePath := storage.ArchivePath + ".tmp"
+	file, err := os.Create(tmpArchivePath)
+	if err != nil {
+		return
+	}
+	if storage.Format == ArchiveFormatZip {
+		err = storage.writeZip(file, filePaths)
+	} else {
+		err = storage.writeTar(file, filePaths)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpArchivePath)
+		return
+	}
+	err = os.Rename(tmpArchivePath, storage.ArchivePath)
+	if err != nil {
+		return
+	}
+	err = os.RemoveAll(storage.BaseDir)
+	return
+}
+
+func (storage *ArchiveStorage) writeZip(writer io.Writer, filePaths []string) (err error) {
+	zipWriter := zip.NewWriter(writer)
+	for _, filePath := range filePaths {
+		var content []byte
+		content, err = storage.Get(filePath)
+		if err != nil {
+			return
+		}
+		header := &zip.FileHeader{
+			Name:   filePath,
+			Method: zip.Deflate,
+		}
+		header.SetModTime(time.Now())
+		var fileWriter io.Writer
+		fileWriter, err = zipWriter.CreateHeader(header)
+		if err != nil {
+			return
+		}
+		_, err = fileWriter.Write(content)
+		if err != nil {
+			return
+		}
+	}
+	err = zipWriter.Close()
+	return
+}
+
+func (storage *ArchiveStorage) writeTar(writer io.Writer, filePaths []string) (err error) {
+	var gzipWriter *gzip.Writer
+	if storage.isGzip() {
+		gzipWriter = gzip.NewWriter(writer)
+		writer = gzipWriter
+	}
+	tarWriter := tar.NewWriter(writer)
+	for _, filePath := range filePaths {
+		var content []byte
+		content, err = storage.Get(filePath)
+		if err != nil {
+			return
+		}
+		header := &tar.Header{
+			Name:     filePath,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil {
+			return
+		}
+		_, err = tarWriter.Write(content)
+		if err != nil {
+			return
+		}
+	}
+	err = tarWriter.Close()
+	if err != nil {
+		return
+	}
+	if gzipWriter != nil {
+		err = gzipWriter.Close()
+	}
+	return
+}
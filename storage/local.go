@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStorage 以本地文件系统的目录作为存储
+type LocalStorage struct {
+	BaseDir string
+}
+
+// NewLocalStorage ...
+func NewLocalStorage(baseDir string) (storage *LocalStorage) {
+	storage = &LocalStorage{
+		BaseDir: baseDir,
+	}
+	return
+}
+
+func (storage *LocalStorage) fullPath(filePath string) string {
+	return filepath.Join(storage.BaseDir, filepath.FromSlash(cleanPath(filePath)))
+}
+
+// tempFilePrefix Put写入的临时文件名的前缀, List()不返回以它起始的文件
+const tempFilePrefix = ".site-mirror-put-"
+
+// Put 先在同一目录中写入临时文件再重命名, 避免进程中途退出时留下不完整的文件.
+func (storage *LocalStorage) Put(filePath string, content []byte) (err error) {
+	fullPath := storage.fullPath(filePath)
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return
+	}
+	file, err := ioutil.TempFile(filepath.Dir(fullPath), tempFilePrefix)
+	if err != nil {
+		return
+	}
+	tmpFilePath := file.Name()
+
+	_, err = file.Write(content)
+	if err == nil {
+		// TempFile创建的文件只有所有者可读, 与直接创建的文件保持一致
+		err = file.Chmod(0644)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilePath)
+		return
+	}
+	err = os.Rename(tmpFilePath, fullPath)
+	if err != nil {
+		os.Remove(tmpFilePath)
+	}
+	return
+}
+
+// Get ...
+func (storage *LocalStorage) Get(filePath string) (content []byte, err error) {
+	return ioutil.ReadFile(storage.fullPath(filePath))
+}
+
+// Exists ...
+func (storage *LocalStorage) Exists(filePath string) (exist bool, err error) {
+	info, err := os.Stat(storage.fullPath(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	exist = !info.IsDir()
+	return
+}
+
+// List ...
+func (storage *LocalStorage) List(prefix string) (filePaths []string, err error) {
+	filePaths = []string{}
+	err = filepath.Walk(storage.BaseDir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 存储目录还不存在时视为空
+			if os.IsNotExist(err) && fullPath == storage.BaseDir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			return nil
+		}
+		relPath, err := filepath.Rel(storage.BaseDir, fullPath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if strings.HasPrefix(relPath, prefix) {
+			filePaths = append(filePaths, relPath)
+		}
+		return nil
+	})
+	return
+}
+
+// Close 本地存储无需额外操作
+func (storage *LocalStorage) Close() (err error) {
+	return
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage 将文件保存在内存中, 一般用于测试.
+type MemoryStorage struct {
+	files map[string][]byte
+	mutex *sync.RWMutex
+}
+
+// NewMemoryStorage ...
+func NewMemoryStorage() (storage *MemoryStorage) {
+	storage = &MemoryStorage{
+		files: map[string][]byte{},
+		mutex: &sync.RWMutex{},
+	}
+	return
+}
+
+// Put ...
+func (storage *MemoryStorage) Put(filePath string, content []byte) (err error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	// 复制一份, 避免调用者之后修改content影响已存储的内容
+	storage.files[cleanPath(filePath)] = append([]byte{}, content...)
+	return
+}
+
+// Get ...
+func (storage *MemoryStorage) Get(filePath string) (content []byte, err error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	stored, exist := storage.files[cleanPath(filePath)]
+	if !exist {
+		err = notExistError("get", filePath)
+		return
+	}
+	content = append([]byte{}, stored...)
+	return
+}
+
+// Exists ...
+func (storage *MemoryStorage) Exists(filePath string) (exist bool, err error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	_, exist = storage.files[cleanPath(filePath)]
+	return
+}
+
+// List ...
+func (storage *MemoryStorage) List(prefix string) (filePaths []string, err error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	filePaths = []string{}
+	for filePath := range storage.files {
+		if strings.HasPrefix(filePath, prefix) {
+			filePaths = append(filePaths, filePath)
+		}
+	}
+	sort.Strings(filePaths)
+	return
+}
+
+// Close ...
+func (storage *MemoryStorage) Close() (err error) {
+	return
+}
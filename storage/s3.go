@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Storage 以S3兼容的对象存储(AWS S3, MinIO, Ceph RGW等)作为存储.
+// 只用到了PutObject, GetObject, HeadObject与ListObjectsV2接口, 请求使用AWS Signature V4签名.
+type S3Storage struct {
+	// 服务地址, 如https://s3.amazonaws.com, 本地的MinIO为http://127.0.0.1:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// 对象键名的前缀, 如`mirrors/site-a/`
+	Prefix string
+	// 为true时使用路径形式的地址(endpoint/bucket/key), MinIO一般需要开启;
+	// 否则使用虚拟主机形式的地址(bucket.endpoint/key).
+	PathStyle bool
+
+	endpointURL *url.URL
+	client      *http.Client
+	// 签名使用的当前时间, 测试时可以替换为固定的时间
+	now func() time.Time
+}
+
+// NewS3Storage ...
+func NewS3Storage(endpoint, region, bucket, accessKey, secretKey, prefix string, pathStyle bool) (storage *S3Storage, err error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		err = fmt.Errorf("s3服务地址不合法: %s, %s", endpoint, err.Error())
+		return
+	}
+	if endpointURL.Scheme == "" || endpointURL.Host == "" {
+		err = fmt.Errorf("s3服务地址不合法, 需要包含协议与主机名: %s", endpoint)
+		return
+	}
+	if bucket == "" {
+		err = fmt.Errorf("未指定s3 bucket")
+		return
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	storage = &S3Storage{
+		Endpoint:  endpoint,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Prefix:    strings.TrimPrefix(prefix, "/"),
+		PathStyle: pathStyle,
+
+		endpointURL: endpointURL,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		now:         time.Now,
+	}
+	return
+}
+
+// Put ...
+func (storage *S3Storage) Put(filePath string, content []byte) (err error) {
+	header := http.Header{}
+	// 根据扩展名设置Content-Type, 以便直接通过对象存储访问镜像站点.
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := storage.do("PUT", storage.Prefix+cleanPath(filePath), nil, header, content)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = storage.responseError("put", filePath, resp)
+	}
+	return
+}
+
+// Get ...
+func (storage *S3Storage) Get(filePath string) (content []byte, err error) {
+	resp, err := storage.do("GET", storage.Prefix+cleanPath(filePath), nil, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		err = notExistError("get", filePath)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = storage.responseError("get", filePath, resp)
+		return
+	}
+	content, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+// Exists ...
+func (storage *S3Storage) Exists(filePath string) (exist bool, err error) {
+	resp, err := storage.do("HEAD", storage.Prefix+cleanPath(filePath), nil, nil, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = storage.responseError("head", filePath, resp)
+		return
+	}
+	exist = true
+	return
+}
+
+// listBucketResult ListObjectsV2接口的响应
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List ...
+func (storage *S3Storage) List(prefix string) (filePaths []string, err error) {
+	filePaths = []string{}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", storage.Prefix+prefix)
+	for {
+		var resp *http.Response
+		resp, err = storage.do("GET", "", query, nil, nil)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = storage.responseError("list", prefix, resp)
+			resp.Body.Close()
+			return
+		}
+		result := &listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+		for _, object := range result.Contents {
+			filePaths = append(filePaths, strings.TrimPrefix(object.Key, storage.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Close ...
+func (storage *S3Storage) Close() (err error) {
+	return
+}
+
+func (storage *S3Storage) responseError(op, filePath string, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("s3 %s失败: %s, status: %d, %s", op, filePath, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// do 发起签名后的请求, key为空时请求的是bucket本身.
+func (storage *S3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (resp *http.Response, err error) {
+	host := storage.endpointURL.Host
+	uriPath := "/" + key
+	if storage.PathStyle {
+		uriPath = "/" + storage.Bucket + uriPath
+	} else {
+		host = storage.Bucket + "." + host
+	}
+	uriPath = strings.TrimSuffix(storage.endpointURL.Path, "/") + uriPath
+
+	reqURL := &url.URL{
+		Scheme:   storage.endpointURL.Scheme,
+		Host:     host,
+		Path:     uriPath,
+		RawPath:  s3URIEncode(uriPath, false),
+		RawQuery: s3CanonicalQuery(query),
+	}
+	req, err := http.NewRequest(method, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	storage.sign(req, reqURL, body, storage.now().UTC())
+	resp, err = storage.client.Do(req)
+	return
+}
+
+// sign AWS Signature V4签名, 只签名host, x-amz-content-sha256与x-amz-date三个请求头.
+func (storage *S3Storage) sign(req *http.Request, reqURL *url.URL, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + reqURL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		reqURL.RawPath,
+		reqURL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + storage.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+storage.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, storage.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		storage.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, content string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(content))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode 按照AWS的规则编码, 除字母数字与`-_.~`外的字符都需要编码, encodeSlash为false时保留斜线.
+func s3URIEncode(input string, encodeSlash bool) string {
+	buf := &bytes.Buffer{}
+	for _, b := range []byte(input) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// s3CanonicalQuery 按键名排序并编码查询参数
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// Storage 镜像文件的存储后端.
+// 文件路径统一使用以斜线/分隔的相对路径, 如`static/css/main.css`, 由各实现自行映射到实际位置.
+// Get()在文件不存在时返回的error满足os.IsNotExist().
+type Storage interface {
+	// Put 写入文件, 已存在时覆盖
+	Put(filePath string, content []byte) error
+	// Get 读取文件内容
+	Get(filePath string) ([]byte, error)
+	// Exists 判断文件是否存在
+	Exists(filePath string) (bool, error)
+	// List 列出以prefix开头的所有文件路径, prefix为空时列出全部
+	List(prefix string) ([]string, error)
+	// Close 结束写入, 如归档类型的存储在此时才会生成最终的归档文件
+	Close() error
+}
+
+// cleanPath 规范化文件路径, 去除起始的斜线及路径中的`..`, 防止写到存储目录之外.
+func cleanPath(filePath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filePath), "/")
+}
+
+// notExistError 构造满足os.IsNotExist()的error
+func notExistError(op, filePath string) error {
+	return &os.PathError{Op: op, Path: filePath, Err: os.ErrNotExist}
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testFiles 各存储共用的测试文件, 包括多级目录, 非ASCII文件名与空文件
+var testFiles = map[string][]byte{
+	"index.html":                []byte("<html>index</html>"),
+	"static/css/main.css":       []byte("body { color: red; }"),
+	"static/img/logo.png":       {0x89, 'P', 'N', 'G', 0x00, 0xff},
+	"cdn.example.com/中文/a.js":   []byte("alert(1)"),
+	"static/empty.txt":          {},
+	"pagewhid=3.html":           []byte("query page"),
+	"static/css/main.css.map":   []byte("{}"),
+	"static/img/logo.png.extra": []byte("extra"),
+}
+
+func newTempDir(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// putTestFiles 写入所有测试文件, 已存在的文件先写入其他内容, 以检查覆盖写入
+func putTestFiles(t *testing.T, storage Storage) {
+	err := storage.Put("index.html", []byte("old content"))
+	if err != nil {
+		t.Fatalf("Put(index.html): %s", err)
+	}
+	for filePath, content := range testFiles {
+		err = storage.Put(filePath, content)
+		if err != nil {
+			t.Fatalf("Put(%s): %s", filePath, err)
+		}
+	}
+}
+
+// checkTestFiles 检查Get, Exists与List的结果与写入的测试文件一致
+func checkTestFiles(t *testing.T, storage Storage) {
+	for filePath, content := range testFiles {
+		stored, err := storage.Get(filePath)
+		if err != nil {
+			t.Errorf("Get(%s): %s", filePath, err)
+			continue
+		}
+		if string(stored) != string(content) {
+			t.Errorf("Get(%s) = %q, 应为%q", filePath, stored, content)
+		}
+		exist, err := storage.Exists(filePath)
+		if err != nil || !exist {
+			t.Errorf("Exists(%s) = %t, %v, 应为true", filePath, exist, err)
+		}
+	}
+	// 以斜线起始的路径与相对路径等价
+	stored, err := storage.Get("/static/css/main.css")
+	if err != nil || string(stored) != string(testFiles["static/css/main.css"]) {
+		t.Errorf("Get(/static/css/main.css) = %q, %v", stored, err)
+	}
+
+	_, err = storage.Get("not/exist.html")
+	if !os.IsNotExist(err) {
+		t.Errorf("Get()不存在的文件应返回os.IsNotExist()的错误, 实际为%v", err)
+	}
+	exist, err := storage.Exists("not/exist.html")
+	if err != nil || exist {
+		t.Errorf("Exists(not/exist.html) = %t, %v, 应为false", exist, err)
+	}
+	// 目录不是文件
+	exist, err = storage.Exists("static/css")
+	if err != nil || exist {
+		t.Errorf("Exists(static/css) = %t, %v, 应为false", exist, err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"static/css/", []string{"static/css/main.css", "static/css/main.css.map"}},
+		{"static/img/logo", []string{"static/img/logo.png", "static/img/logo.png.extra"}},
+		{"none/", []string{}},
+	}
+	for _, test := range tests {
+		filePaths, err := storage.List(test.prefix)
+		if err != nil {
+			t.Errorf("List(%s): %s", test.prefix, err)
+			continue
+		}
+		sort.Strings(filePaths)
+		if !reflect.DeepEqual(filePaths, test.want) {
+			t.Errorf("List(%s) = %v, 应为%v", test.prefix, filePaths, test.want)
+		}
+	}
+	filePaths, err := storage.List("")
+	if err != nil {
+		t.Fatalf("List(): %s", err)
+	}
+	if len(filePaths) != len(testFiles) {
+		t.Errorf("List()返回%d个文件, 应为%d个: %v", len(filePaths), len(testFiles), filePaths)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	putTestFiles(t, storage)
+	checkTestFiles(t, storage)
+
+	// 写入后修改原切片不影响已存储的内容
+	content := []byte("abc")
+	storage.Put("copy.txt", content)
+	content[0] = 'x'
+	stored, _ := storage.Get("copy.txt")
+	if string(stored) != "abc" {
+		t.Errorf("存储的内容被调用者修改: %q", stored)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	baseDir := filepath.Join(dir, "site")
+	storage := NewLocalStorage(baseDir)
+
+	// 存储目录还不存在时视为空
+	filePaths, err := storage.List("")
+	if err != nil || len(filePaths) != 0 {
+		t.Errorf("空存储List() = %v, %v", filePaths, err)
+	}
+
+	putTestFiles(t, storage)
+	checkTestFiles(t, storage)
+
+	// 写入完成后不应留下临时文件
+	err = filepath.Walk(baseDir, func(fullPath string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), tempFilePrefix) {
+			t.Errorf("留下了临时文件: %s", fullPath)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 未完成的临时文件不出现在List()中, 以.tmp结尾的普通文件则与其他文件一样
+	err = ioutil.WriteFile(filepath.Join(baseDir, "static", tempFilePrefix+"123"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTestFiles(t, storage)
+	err = storage.Put("static/x.tmp", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePaths, err = storage.List("static/x")
+	if err != nil || !reflect.DeepEqual(filePaths, []string{"static/x.tmp"}) {
+		t.Errorf("List(static/x) = %v, %v, 应为[static/x.tmp]", filePaths, err)
+	}
+	info, err := os.Stat(filepath.Join(baseDir, "static", "x.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("写入的文件权限为%v, 应为0644", info.Mode().Perm())
+	}
+
+	// 路径中的..不能写到存储目录之外
+	err = storage.Put("../../outside.txt", []byte("outside"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "outside.txt")); !os.IsNotExist(err) {
+		t.Error("文件被写到了存储目录之外")
+	}
+	if _, err = os.Stat(filepath.Join(baseDir, "outside.txt")); err != nil {
+		t.Errorf("文件应写入存储目录中: %s", err)
+	}
+}
+
+func TestArchiveStorage(t *testing.T) {
+	tests := []struct {
+		format      string
+		archiveName string
+	}{
+		{ArchiveFormatZip, "site.zip"},
+		{ArchiveFormatTar, "site.tar"},
+		{ArchiveFormatTar, "site.tar.gz"},
+	}
+	for _, test := range tests {
+		dir := newTempDir(t)
+		archivePath := filepath.Join(dir, test.archiveName)
+
+		storage, err := NewArchiveStorage(archivePath, test.format)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%s: %s", test.archiveName, err)
+		}
+		putTestFiles(t, storage)
+		checkTestFiles(t, storage)
+		err = storage.Close()
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%s: Close(): %s", test.archiveName, err)
+		}
+		if _, err = os.Stat(archivePath + ".staging"); !os.IsNotExist(err) {
+			t.Errorf("%s: Close()后应删除暂存目录", test.archiveName)
+		}
+		if _, err = os.Stat(archivePath + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%s: Close()后不应留下临时文件", test.archiveName)
+		}
+
+		// 重新打开时从归档文件中解压, 内容与写入的一致
+		storage, err = NewArchiveStorage(archivePath, test.format)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%s: 重新打开失败: %s", test.archiveName, err)
+		}
+		checkTestFiles(t, storage)
+
+		// 继续写入后再次打包, 新旧文件都在归档文件中
+		err = storage.Put("added.html", []byte("added"))
+		if err == nil {
+			err = storage.Close()
+		}
+		if err == nil {
+			storage, err = NewArchiveStorage(archivePath, test.format)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("%s: %s", test.archiveName, err)
+		}
+		stored, err := storage.Get("added.html")
+		if err != nil || string(stored) != "added" {
+			t.Errorf("%s: Get(added.html) = %q, %v", test.archiveName, stored, err)
+		}
+		filePaths, err := storage.List("")
+		if err != nil || len(filePaths) != len(testFiles)+1 {
+			t.Errorf("%s: List() = %v, %v, 应为%d个文件", test.archiveName, filePaths, err, len(testFiles)+1)
+		}
+		os.RemoveAll(dir)
+	}
+
+	_, err := NewArchiveStorage("site.rar", "rar")
+	if err == nil {
+		t.Error("不支持的归档格式应当报错")
+	}
+}
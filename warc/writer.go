@@ -0,0 +1,215 @@
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 相同内容的重复响应使用revisit记录时遵循的规范
+const revisitProfile = "http://netpreserve.org/warc/1.1/revisit/identical-payload-digest"
+
+// revisitTarget 某个payload摘要第一次出现时的记录信息, 用于生成revisit记录
+type revisitTarget struct {
+	targetURI string
+	date      string
+}
+
+// Writer WARC 1.1格式文件的写入器, 并发安全.
+// 每次http请求写入一对request/response记录, 响应体不为空且与之前记录过的内容完全相同时,
+// response记录替换为只包含响应头的revisit记录.
+// 文件名以.gz结尾时, 每条记录单独进行gzip压缩(多个gzip成员依次拼接), 这是WARC工具普遍支持的格式.
+// 打开已存在的文件时会在末尾追加, 以支持继续上一次的抓取.
+type Writer struct {
+	FilePath string
+
+	file     *os.File
+	compress bool
+	mutex    *sync.Mutex
+	// payload摘要 -> 第一次出现时的记录信息
+	digests map[string]*revisitTarget
+}
+
+// NewWriter 打开(或创建)WARC文件, 并写入一条warcinfo记录.
+func NewWriter(filePath string, software string) (writer *Writer, err error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	writer = &Writer{
+		FilePath: filePath,
+
+		file:     file,
+		compress: strings.HasSuffix(filePath, ".gz"),
+		mutex:    &sync.Mutex{},
+		digests:  map[string]*revisitTarget{},
+	}
+
+	fields := &bytes.Buffer{}
+	fmt.Fprintf(fields, "software: %s\r\n", software)
+	fmt.Fprintf(fields, "format: WARC File Format 1.1\r\n")
+	fmt.Fprintf(fields, "conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+	headers := [][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Filename", filepath.Base(filePath)},
+		{"Content-Type", "application/warc-fields"},
+	}
+	err = writer.writeRecord(headers, fields.Bytes())
+	if err != nil {
+		file.Close()
+		writer = nil
+	}
+	return
+}
+
+// WriteExchange 写入一次http请求与响应, 重定向链中的每一跳需要分别写入.
+// resp.Request为这一跳实际发出的请求, body为服务端发送的原始响应体(按Content-Encoding压缩的内容不解码),
+// 这样payload摘要与回放时的内容都与服务端一致.
+func (writer *Writer) WriteExchange(resp *http.Response, body []byte) (err error) {
+	req := resp.Request
+	targetURI := req.URL.String()
+	date := warcDate(time.Now())
+
+	requestBlock := &bytes.Buffer{}
+	fmt.Fprintf(requestBlock, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(requestBlock, "Host: %s\r\n", req.URL.Host)
+	req.Header.Write(requestBlock)
+	requestBlock.WriteString("\r\n")
+
+	responseHeader := &bytes.Buffer{}
+	fmt.Fprintf(responseHeader, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(responseHeader)
+	responseHeader.WriteString("\r\n")
+
+	payloadDigest := sha1Digest(body)
+	responseID := newRecordID()
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	var responseHeaders [][2]string
+	var responseBlock []byte
+	// 空的响应体(如重定向, 304)各不相同, 只是没有内容, 不能作为重复内容替换为revisit记录
+	var target *revisitTarget
+	isRevisit := false
+	if len(body) > 0 {
+		target, isRevisit = writer.digests[payloadDigest]
+	}
+	if isRevisit {
+		responseHeaders = [][2]string{
+			{"WARC-Type", "revisit"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", targetURI},
+			{"WARC-Profile", revisitProfile},
+			{"WARC-Refers-To-Target-URI", target.targetURI},
+			{"WARC-Refers-To-Date", target.date},
+			{"WARC-Payload-Digest", payloadDigest},
+			{"Content-Type", "application/http;msgtype=response"},
+		}
+		responseBlock = responseHeader.Bytes()
+	} else {
+		responseHeaders = [][2]string{
+			{"WARC-Type", "response"},
+			{"WARC-Record-ID", responseID},
+			{"WARC-Date", date},
+			{"WARC-Target-URI", targetURI},
+			{"WARC-Payload-Digest", payloadDigest},
+			{"Content-Type", "application/http;msgtype=response"},
+		}
+		responseBlock = append(responseHeader.Bytes(), body...)
+		if len(body) > 0 {
+			writer.digests[payloadDigest] = &revisitTarget{
+				targetURI: targetURI,
+				date:      date,
+			}
+		}
+	}
+	responseHeaders = append(responseHeaders, [2]string{"WARC-Block-Digest", sha1Digest(responseBlock)})
+	err = writer.writeRecord(responseHeaders, responseBlock)
+	if err != nil {
+		return
+	}
+
+	requestHeaders := [][2]string{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", targetURI},
+		{"WARC-Concurrent-To", responseID},
+		{"WARC-Block-Digest", sha1Digest(requestBlock.Bytes())},
+		{"Content-Type", "application/http;msgtype=request"},
+	}
+	err = writer.writeRecord(requestHeaders, requestBlock.Bytes())
+	return
+}
+
+// Close ...
+func (writer *Writer) Close() (err error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.file.Close()
+}
+
+// writeRecord 写入一条记录, 调用者需持有mutex(NewWriter中除外).
+// 整条记录先在内存中拼好再一次写入, 避免中途出错时留下不完整的记录.
+func (writer *Writer) writeRecord(headers [][2]string, block []byte) (err error) {
+	record := &bytes.Buffer{}
+	record.WriteString("WARC/1.1\r\n")
+	for _, header := range headers {
+		fmt.Fprintf(record, "%s: %s\r\n", header[0], header[1])
+	}
+	fmt.Fprintf(record, "Content-Length: %d\r\n", len(block))
+	record.WriteString("\r\n")
+	record.Write(block)
+	record.WriteString("\r\n\r\n")
+
+	var output io.Reader = record
+	if writer.compress {
+		compressed := &bytes.Buffer{}
+		gzipWriter := gzip.NewWriter(compressed)
+		_, err = gzipWriter.Write(record.Bytes())
+		if err != nil {
+			return
+		}
+		err = gzipWriter.Close()
+		if err != nil {
+			return
+		}
+		output = compressed
+	}
+	_, err = io.Copy(writer.file, output)
+	return
+}
+
+// sha1Digest WARC中常用的`sha1:<base32>`格式摘要
+func sha1Digest(content []byte) string {
+	hash := sha1.Sum(content)
+	return "sha1:" + base32.StdEncoding.EncodeToString(hash[:])
+}
+
+// warcDate WARC-Date字段要求的UTC时间格式
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// newRecordID 生成`<urn:uuid:...>`格式的记录ID, 使用随机的v4 uuid
+func newRecordID() string {
+	uuid := make([]byte, 16)
+	rand.Read(uuid)
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
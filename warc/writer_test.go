@@ -0,0 +1,82 @@
+package warc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+var warcTypePattern = regexp.MustCompile(`(?m)^WARC-Type: (\S+)\r$`)
+
+// newTestResponse 构造一个已完成的响应, 只包含写入记录需要的字段
+func newTestResponse(t *testing.T, rawURL string, status string) (resp *http.Response) {
+	reqURL, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = &http.Response{
+		Status:     status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    &http.Request{Method: "GET", URL: reqURL, Header: http.Header{}},
+	}
+	return
+}
+
+// 只有内容相同且不为空的响应体才写入revisit记录
+func TestWriteExchangeRevisit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writer, err := NewWriter(filepath.Join(dir, "site.warc"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := []struct {
+		url    string
+		status string
+		body   string
+	}{
+		{"http://example.com/a", "301 Moved Permanently", ""},
+		{"http://example.com/b", "304 Not Modified", ""},
+		{"http://example.com/c.png", "200 OK", "png"},
+		{"http://example.com/d.png", "200 OK", "png"},
+		{"http://example.com/e", "302 Found", ""},
+	}
+	for _, exchange := range exchanges {
+		err = writer.WriteExchange(newTestResponse(t, exchange.url, exchange.status), []byte(exchange.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	content, err := ioutil.ReadFile(writer.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := []string{}
+	for _, match := range warcTypePattern.FindAllStringSubmatch(string(content), -1) {
+		types = append(types, match[1])
+	}
+	want := []string{
+		"warcinfo",
+		"response", "request",
+		"response", "request",
+		"response", "request",
+		"revisit", "request",
+		"response", "request",
+	}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("记录类型为%v, 应为%v", types, want)
+	}
+}